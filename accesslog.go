@@ -0,0 +1,161 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the records of an AccessLog.
+type AccessLogFormat string
+
+const (
+	// AccessLogJSON writes a JSON object per record.
+	AccessLogJSON AccessLogFormat = "json"
+	// AccessLogLogfmt writes key=value pairs per record.
+	AccessLogLogfmt AccessLogFormat = "logfmt"
+	// AccessLogSquid writes the native format of the access.log of Squid.
+	AccessLogSquid AccessLogFormat = "squid"
+	// AccessLogCombined writes the NCSA combined log format.
+	AccessLogCombined AccessLogFormat = "combined"
+)
+
+// AccessLog is an Observer writing a record per request and tunnel.
+type AccessLog struct {
+	NopObserver
+	// Writer receives the records, os.Stdout if nil
+	Writer io.Writer
+	// Format is the format of the records, AccessLogJSON if empty
+	Format AccessLogFormat
+
+	once    sync.Once
+	mut     sync.Mutex
+	handler slog.Handler
+}
+
+func (l *AccessLog) RequestDone(r *http.Request, info RequestInfo) {
+	l.log(time.Now(), r, info)
+}
+
+func (l *AccessLog) writer() io.Writer {
+	if l.Writer != nil {
+		return l.Writer
+	}
+	return os.Stdout
+}
+
+// log writes the record of a request that finished at end.
+func (l *AccessLog) log(end time.Time, r *http.Request, info RequestInfo) {
+	switch l.Format {
+	case AccessLogSquid:
+		l.write(squidRecord(end, r, info))
+	case AccessLogCombined:
+		l.write(combinedRecord(end, r, info))
+	case "", AccessLogJSON, AccessLogLogfmt:
+		l.once.Do(func() {
+			opts := &slog.HandlerOptions{
+				ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+					// The records have no level and no message.
+					if len(groups) == 0 && (a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+						return slog.Attr{}
+					}
+					return a
+				},
+			}
+			if l.Format == AccessLogLogfmt {
+				l.handler = slog.NewTextHandler(l.writer(), opts)
+			} else {
+				l.handler = slog.NewJSONHandler(l.writer(), opts)
+			}
+		})
+		record := slog.NewRecord(end, slog.LevelInfo, "", 0)
+		record.AddAttrs(
+			slog.String("client", clientIP(r)),
+			slog.String("identity", IdentityFromContext(r.Context())),
+			slog.String("method", r.Method),
+			slog.String("target", accessTarget(r)),
+			slog.Int("status", info.StatusCode),
+			slog.Int64("upload", info.Upload),
+			slog.Int64("download", info.Download),
+			slog.Float64("duration", info.Duration.Seconds()),
+			slog.Float64("dial_duration", info.DialDuration.Seconds()),
+			slog.String("route", info.Route),
+			slog.String("upstream", info.Upstream),
+		)
+		if info.Err != nil {
+			record.AddAttrs(slog.String("error", info.Err.Error()))
+		}
+		l.handler.Handle(context.Background(), record)
+	}
+}
+
+func (l *AccessLog) write(line string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	io.WriteString(l.writer(), line)
+}
+
+// squidRecord formats a line of the native access.log of Squid.
+func squidRecord(end time.Time, r *http.Request, info RequestInfo) string {
+	code := "TCP_MISS"
+	switch {
+	case r.Method == http.MethodConnect && info.StatusCode == http.StatusOK:
+		code = "TCP_TUNNEL"
+	case info.StatusCode == http.StatusProxyAuthRequired, info.StatusCode == http.StatusForbidden,
+		info.StatusCode == http.StatusTooManyRequests:
+		code = "TCP_DENIED"
+	}
+	hierarchy := "HIER_NONE/-"
+	switch {
+	case info.Upstream != "":
+		hierarchy = "FIRSTUP_PARENT/" + hostOf(info.Upstream)
+	case info.Route != "":
+		hierarchy = "HIER_DIRECT/" + hostOf(info.Address)
+	}
+	return fmt.Sprintf("%d.%03d %6d %s %s/%03d %d %s %s %s %s -\n",
+		end.Unix(), end.Nanosecond()/int(time.Millisecond), info.Duration.Milliseconds(),
+		clientIP(r), code, info.StatusCode, info.Download, r.Method, accessTarget(r),
+		orDash(IdentityFromContext(r.Context())), hierarchy)
+}
+
+// combinedRecord formats a line of the NCSA combined log format.
+func combinedRecord(end time.Time, r *http.Request, info RequestInfo) string {
+	start := end.Add(-info.Duration)
+	return fmt.Sprintf("%s - %s [%s] %s %d %d %s %s\n",
+		clientIP(r), orDash(IdentityFromContext(r.Context())), start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+accessTarget(r)+" "+r.Proto), info.StatusCode, info.Download,
+		strconv.Quote(orDash(r.Referer())), strconv.Quote(orDash(r.UserAgent())))
+}
+
+// accessTarget returns the target of the request as the client sent it.
+func accessTarget(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodConnect && r.URL.Host != "" && r.URL.Path == "":
+		return r.URL.Host
+	case r.URL.Host != "":
+		return r.URL.String()
+	}
+	return r.URL.RequestURI()
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
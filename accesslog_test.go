@@ -0,0 +1,128 @@
+package httpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	end := time.Date(2024, 5, 6, 7, 8, 9, 250*int(time.Millisecond), time.UTC)
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/a?b=c", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "test/1.0")
+	r = r.WithContext(ContextWithIdentity(r.Context(), "alice"))
+	info := RequestInfo{
+		Address:      "example.com:80",
+		Route:        "parent",
+		Upstream:     "parent.example:3128",
+		StatusCode:   200,
+		Upload:       3,
+		Download:     42,
+		Duration:     1500 * time.Millisecond,
+		DialDuration: 250 * time.Millisecond,
+		Err:          errors.New("broken pipe"),
+	}
+
+	tests := []struct {
+		format AccessLogFormat
+		want   string
+	}{
+		{
+			format: AccessLogJSON,
+			want:   `{"time":"2024-05-06T07:08:09.25Z","client":"192.0.2.1","identity":"alice","method":"GET","target":"http://example.com/a?b=c","status":200,"upload":3,"download":42,"duration":1.5,"dial_duration":0.25,"route":"parent","upstream":"parent.example:3128","error":"broken pipe"}` + "\n",
+		},
+		{
+			format: AccessLogLogfmt,
+			want:   `time=2024-05-06T07:08:09.250Z client=192.0.2.1 identity=alice method=GET target="http://example.com/a?b=c" status=200 upload=3 download=42 duration=1.5 dial_duration=0.25 route=parent upstream=parent.example:3128 error="broken pipe"` + "\n",
+		},
+		{
+			format: AccessLogSquid,
+			want:   "1714979289.250   1500 192.0.2.1 TCP_MISS/200 42 GET http://example.com/a?b=c alice FIRSTUP_PARENT/parent.example -\n",
+		},
+		{
+			format: AccessLogCombined,
+			want:   `192.0.2.1 - alice [06/May/2024:07:08:07 +0000] "GET http://example.com/a?b=c HTTP/1.1" 200 42 "-" "test/1.0"` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			var buf bytes.Buffer
+			l := &AccessLog{Writer: &buf, Format: tt.format}
+			l.log(end, r, info)
+			if got := buf.String(); got != tt.want {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mut sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf lockedBuffer
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("alice", "secret"),
+		Observer:       &AccessLog{Writer: &buf},
+	})
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("alice", "secret")
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := countingServer(t)
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello")
+	closeWrite(conn)
+	io.ReadAll(conn)
+	conn.Close()
+
+	for i := 0; len(buf.Bytes()) == 0 && i != 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var record struct {
+		Identity string `json:"identity"`
+		Method   string `json:"method"`
+		Target   string `json:"target"`
+		Status   int    `json:"status"`
+		Upload   int64  `json:"upload"`
+		Download int64  `json:"download"`
+		Route    string `json:"route"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	if record.Identity != "alice" || record.Method != http.MethodConnect || record.Target != target ||
+		record.Status != http.StatusOK || record.Upload != 5 || record.Download != 1 || record.Route != Direct {
+		t.Fatalf("unexpected record %s", buf.Bytes())
+	}
+}
@@ -0,0 +1,441 @@
+package httpproxy
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultAccountingSaveInterval is how often the counters are written to the file.
+	DefaultAccountingSaveInterval = time.Minute
+	// DefaultAccountingMaxDestinations is the default number of destinations counted per identity.
+	DefaultAccountingMaxDestinations = 1000
+
+	// OtherDestinations is the destination of the traffic beyond the destinations counted per identity.
+	OtherDestinations = "*"
+)
+
+// Usage is the traffic of an identity to a destination host.
+type Usage struct {
+	Identity    string `json:"identity"`
+	Destination string `json:"destination"`
+	Requests    int64  `json:"requests"`
+	// Upload is the bytes from the client to the destination
+	Upload int64 `json:"upload"`
+	// Download is the bytes from the destination to the client
+	Download int64 `json:"download"`
+}
+
+// Quota limits the bytes in both directions of an identity.
+type Quota struct {
+	// Daily is the limit of a calendar day, unlimited if zero
+	Daily int64 `json:"daily,omitempty"`
+	// Monthly is the limit of a calendar month, unlimited if zero
+	Monthly int64 `json:"monthly,omitempty"`
+}
+
+// QuotaUsage is the usage of the quota of an identity in the current periods.
+type QuotaUsage struct {
+	Identity     string `json:"identity"`
+	Day          string `json:"day"`
+	DailyBytes   int64  `json:"daily_bytes"`
+	Month        string `json:"month"`
+	MonthlyBytes int64  `json:"monthly_bytes"`
+	Quota        Quota  `json:"quota"`
+}
+
+// QuotaExceededError is returned for requests of an identity over its quota.
+type QuotaExceededError struct {
+	Identity string
+	Period   string
+	Reset    time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota of %q exceeded until %s", e.Period, e.Identity, e.Reset.Format(time.RFC3339))
+}
+
+// Accounting counts the requests and bytes per identity and destination host
+// and enforces quotas. Tunnels are counted when they close, so a tunnel open
+// while its identity exceeds the quota is not interrupted, the next request is
+// rejected. Accounting is an http.Handler reporting the counters on GET and
+// resetting them on DELETE, both optionally for ?identity= only.
+type Accounting struct {
+	// File persists the counters as JSON, they are kept in memory only if empty
+	File string
+	// SaveInterval is how often Run saves the counters, DefaultAccountingSaveInterval if zero
+	SaveInterval time.Duration
+	// Quota applies to each authenticated identity without its own quota
+	Quota Quota
+	// Quotas are the quotas of specific identities
+	Quotas map[string]Quota
+	// QuotaStatusCode is the status of requests over the quota, http.StatusForbidden if zero.
+	// With http.StatusTooManyRequests the Retry-After is the start of the next period.
+	QuotaStatusCode int
+	// Location is the time zone of the days and months, time.Local if nil
+	Location *time.Location
+	// Logger logs failed saves if not nil
+	Logger *slog.Logger
+	// MaxDestinations is the number of destinations counted per identity, DefaultAccountingMaxDestinations if zero.
+	// The traffic to further destinations is counted under OtherDestinations.
+	MaxDestinations int
+
+	mut     sync.Mutex
+	usage   map[usageKey]*Usage
+	periods map[string]*quotaPeriods
+	// destinations is the number of destinations of each identity in usage
+	destinations map[string]int
+}
+
+type usageKey struct {
+	identity    string
+	destination string
+}
+
+// quotaPeriods are the bytes of an identity in the current day and month.
+type quotaPeriods struct {
+	Day          string `json:"day"`
+	DailyBytes   int64  `json:"daily_bytes"`
+	Month        string `json:"month"`
+	MonthlyBytes int64  `json:"monthly_bytes"`
+}
+
+// accountingFile is the format of Accounting.File.
+type accountingFile struct {
+	Usage   []Usage                  `json:"usage"`
+	Periods map[string]*quotaPeriods `json:"periods"`
+}
+
+func (a *Accounting) location() *time.Location {
+	if a.Location != nil {
+		return a.Location
+	}
+	return time.Local
+}
+
+// roll starts new periods once the day or month changed.
+func (q *quotaPeriods) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); q.Day != day {
+		q.Day = day
+		q.DailyBytes = 0
+	}
+	if month := now.Format("2006-01"); q.Month != month {
+		q.Month = month
+		q.MonthlyBytes = 0
+	}
+}
+
+// Add counts a request of identity to destination.
+func (a *Accounting) Add(identity, destination string, upload, download int64) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	key := usageKey{identity, destination}
+	u, ok := a.usage[key]
+	if !ok && a.destinations[identity] >= a.maxDestinations() {
+		key.destination = OtherDestinations
+		u, ok = a.usage[key]
+	}
+	if !ok {
+		if a.usage == nil {
+			a.usage = map[usageKey]*Usage{}
+			a.destinations = map[string]int{}
+		}
+		u = &Usage{Identity: identity, Destination: key.destination}
+		a.usage[key] = u
+		a.destinations[identity]++
+	}
+	u.Requests++
+	u.Upload += upload
+	u.Download += download
+
+	if a.periods == nil {
+		a.periods = map[string]*quotaPeriods{}
+	}
+	q, ok := a.periods[identity]
+	if !ok {
+		q = &quotaPeriods{}
+		a.periods[identity] = q
+	}
+	q.roll(time.Now().In(a.location()))
+	q.DailyBytes += upload + download
+	q.MonthlyBytes += upload + download
+}
+
+func (a *Accounting) maxDestinations() int {
+	if a.MaxDestinations > 0 {
+		return a.MaxDestinations
+	}
+	return DefaultAccountingMaxDestinations
+}
+
+func (a *Accounting) quota(identity string) Quota {
+	if q, ok := a.Quotas[identity]; ok {
+		return q
+	}
+	return a.Quota
+}
+
+// Check returns a *QuotaExceededError if identity exceeded its quota,
+// anonymous clients have no quota.
+func (a *Accounting) Check(identity string) error {
+	if identity == "" {
+		return nil
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	q, ok := a.periods[identity]
+	if !ok {
+		return nil
+	}
+	now := time.Now().In(a.location())
+	q.roll(now)
+	quota := a.quota(identity)
+	if quota.Daily > 0 && q.DailyBytes >= quota.Daily {
+		y, m, d := now.Date()
+		return &QuotaExceededError{Identity: identity, Period: "daily", Reset: time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())}
+	}
+	if quota.Monthly > 0 && q.MonthlyBytes >= quota.Monthly {
+		y, m, _ := now.Date()
+		return &QuotaExceededError{Identity: identity, Period: "monthly", Reset: time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())}
+	}
+	return nil
+}
+
+// Report returns the usage sorted by identity and destination, of identity only if not empty.
+func (a *Accounting) Report(identity string) []Usage {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	usage := make([]Usage, 0, len(a.usage))
+	for _, u := range a.usage {
+		if identity == "" || u.Identity == identity {
+			usage = append(usage, *u)
+		}
+	}
+	slices.SortFunc(usage, func(a, b Usage) int {
+		return cmp.Or(cmp.Compare(a.Identity, b.Identity), cmp.Compare(a.Destination, b.Destination))
+	})
+	return usage
+}
+
+// QuotaReport returns the quota usage sorted by identity, of identity only if not empty.
+func (a *Accounting) QuotaReport(identity string) []QuotaUsage {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	now := time.Now().In(a.location())
+	report := make([]QuotaUsage, 0, len(a.periods))
+	for id, q := range a.periods {
+		if identity != "" && id != identity {
+			continue
+		}
+		q.roll(now)
+		report = append(report, QuotaUsage{
+			Identity:     id,
+			Day:          q.Day,
+			DailyBytes:   q.DailyBytes,
+			Month:        q.Month,
+			MonthlyBytes: q.MonthlyBytes,
+			Quota:        a.quota(id),
+		})
+	}
+	slices.SortFunc(report, func(a, b QuotaUsage) int {
+		return cmp.Compare(a.Identity, b.Identity)
+	})
+	return report
+}
+
+// Reset clears the counters and quota usage of identity, of everyone if empty.
+func (a *Accounting) Reset(identity string) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if identity == "" {
+		a.usage = nil
+		a.periods = nil
+		a.destinations = nil
+		return
+	}
+	for key := range a.usage {
+		if key.identity == identity {
+			delete(a.usage, key)
+		}
+	}
+	delete(a.destinations, identity)
+	delete(a.periods, identity)
+}
+
+// Load reads the counters from File, a missing file is not an error.
+func (a *Accounting) Load() error {
+	if a.File == "" {
+		return nil
+	}
+	data, err := os.ReadFile(a.File)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var f accountingFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", a.File, err)
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.usage = make(map[usageKey]*Usage, len(f.Usage))
+	a.destinations = map[string]int{}
+	for i := range f.Usage {
+		u := f.Usage[i]
+		a.usage[usageKey{u.Identity, u.Destination}] = &u
+		a.destinations[u.Identity]++
+	}
+	a.periods = f.Periods
+	return nil
+}
+
+// Save writes the counters to File.
+func (a *Accounting) Save() error {
+	if a.File == "" {
+		return nil
+	}
+	a.mut.Lock()
+	f := accountingFile{
+		Usage:   make([]Usage, 0, len(a.usage)),
+		Periods: make(map[string]*quotaPeriods, len(a.periods)),
+	}
+	for _, u := range a.usage {
+		f.Usage = append(f.Usage, *u)
+	}
+	for id, q := range a.periods {
+		q := *q
+		f.Periods[id] = &q
+	}
+	a.mut.Unlock()
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file and rename it, so a crash never leaves a partial file.
+	tmp, err := os.CreateTemp(filepath.Dir(a.File), filepath.Base(a.File)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), a.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Run saves the counters every SaveInterval and once more when ctx is done.
+func (a *Accounting) Run(ctx context.Context) error {
+	interval := a.SaveInterval
+	if interval == 0 {
+		interval = DefaultAccountingSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			err := a.Save()
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-ticker.C:
+			err := a.Save()
+			if err != nil && a.Logger != nil {
+				a.Logger.Error("save accounting failed", "file", a.File, "err", err)
+			}
+		}
+	}
+}
+
+// ServeHTTP reports the counters on GET and resets them on DELETE.
+func (a *Accounting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity := r.URL.Query().Get("identity")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Usage  []Usage      `json:"usage"`
+			Quotas []QuotaUsage `json:"quotas"`
+		}{a.Report(identity), a.QuotaReport(identity)})
+	case http.MethodDelete:
+		a.Reset(identity)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// checkQuota responds with Accounting.QuotaStatusCode if the client exceeded its quota.
+func (p *ProxyHandler) checkQuota(w http.ResponseWriter, r *http.Request) bool {
+	err := p.Accounting.Check(IdentityFromContext(r.Context()))
+	if err == nil {
+		return true
+	}
+	e := err.Error()
+	if p.Logger != nil {
+		p.Logger.Warn(e)
+	}
+	code := p.Accounting.QuotaStatusCode
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+	if err, ok := err.(*QuotaExceededError); ok && code == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(err.Reset).Seconds()))))
+	}
+	http.Error(w, e, code)
+	return false
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// account counts a request of the client to address.
+func (p *ProxyHandler) account(r *http.Request, address string, upload, download int64) {
+	if p.Accounting == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	p.Accounting.Add(IdentityFromContext(r.Context()), host, upload, download)
+}
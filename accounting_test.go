@@ -0,0 +1,226 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccounting(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer target.Close()
+	accounting := &Accounting{Quota: Quota{Daily: 29}, QuotaStatusCode: http.StatusTooManyRequests}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("alice", "secret"),
+		Accounting:     accounting,
+	})
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("alice", "secret")
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tunnel uploading 5 bytes and downloading 1.
+	conn, err := dialer.Dial("tcp", countingServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello")
+	closeWrite(conn)
+	io.ReadAll(conn)
+	conn.Close()
+	// A request uploading 3 bytes and downloading 10.
+	resp, err := cli.Post(target.URL, "text/plain", strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	want := []Usage{{Identity: "alice", Destination: "127.0.0.1", Requests: 2, Upload: 8, Download: 11}}
+	for i := 0; ; i++ {
+		got := accounting.Report("")
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Another 10 bytes reach the daily quota of 29.
+	resp, err = cli.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = cli.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatal(resp.Status, resp.Header)
+	}
+
+	accounting.Reset("alice")
+	resp, err = cli.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("quota not reset", resp.Status)
+	}
+}
+
+func TestAccountingPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	a := &Accounting{File: file, SaveInterval: 10 * time.Millisecond}
+	a.Add("alice", "example.com", 1, 2)
+	a.Add("bob", "example.org", 3, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := a.Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	b := &Accounting{File: file}
+	err = b.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a.Report(""), b.Report("")) {
+		t.Fatal(a.Report(""), b.Report(""))
+	}
+	if !reflect.DeepEqual(a.QuotaReport(""), b.QuotaReport("")) {
+		t.Fatal(a.QuotaReport(""), b.QuotaReport(""))
+	}
+}
+
+func TestAccountingAPI(t *testing.T) {
+	a := &Accounting{Quotas: map[string]Quota{"alice": {Monthly: 100}}}
+	a.Add("alice", "example.com", 1, 2)
+	a.Add("bob", "example.org", 3, 4)
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?identity=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Usage  []Usage      `json:"usage"`
+		Quotas []QuotaUsage `json:"quotas"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Usage) != 1 || report.Usage[0].Download != 2 || len(report.Quotas) != 1 || report.Quotas[0].MonthlyBytes != 3 || report.Quotas[0].Quota.Monthly != 100 {
+		t.Fatalf("%+v", report)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"?identity=bob", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.Status)
+	}
+	if usage := a.Report(""); len(usage) != 1 || usage[0].Identity != "alice" {
+		t.Fatal(usage)
+	}
+}
+
+func TestAccountingMaxDestinations(t *testing.T) {
+	accounting := &Accounting{MaxDestinations: 2}
+	for _, destination := range []string{"a.test", "b.test", "c.test", "d.test", "a.test"} {
+		accounting.Add("alice", destination, 1, 2)
+	}
+	accounting.Add("bob", "c.test", 1, 2)
+
+	want := []Usage{
+		{Identity: "alice", Destination: OtherDestinations, Requests: 2, Upload: 2, Download: 4},
+		{Identity: "alice", Destination: "a.test", Requests: 2, Upload: 2, Download: 4},
+		{Identity: "alice", Destination: "b.test", Requests: 1, Upload: 1, Download: 2},
+		{Identity: "bob", Destination: "c.test", Requests: 1, Upload: 1, Download: 2},
+	}
+	if got := accounting.Report(""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAccountingUDP(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	accounting := &Accounting{}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("alice", "secret"),
+		Accounting:     accounting,
+		UDPRelay:       true,
+	})
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("alice", "secret")
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CONNECT-UDP and the UDP relay each echo 4 bytes.
+	conn, err := dialer.DialUDP("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := dialer.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []net.PacketConn{conn, relay} {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.WriteTo([]byte("ping"), echo.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = c.ReadFrom(make([]byte, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	want := []Usage{{Identity: "alice", Destination: "127.0.0.1", Requests: 2, Upload: 8, Download: 8}}
+	for i := 0; ; i++ {
+		got := accounting.Report("")
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
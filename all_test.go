@@ -1,9 +1,11 @@
 package httpproxy
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -304,6 +306,45 @@ func TestConnectAuth(t *testing.T) {
 	}
 }
 
+func TestConnectServerFirst(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		// The greeting of the destination arrives together with the response.
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-test\r\n")
+		io.Copy(io.Discard, conn)
+	}()
+
+	dialer, err := NewDialer("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "SSH-2.0-test\r\n" {
+		t.Fatal(line)
+	}
+}
+
 func TestAuth(t *testing.T) {
 	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "check", r.RequestURI)
@@ -411,6 +452,66 @@ func BenchmarkConnect(b *testing.B) {
 	}
 }
 
+// benchmarkConnectBulk measures the upload throughput of a CONNECT tunnel.
+func benchmarkConnectBulk(b *testing.B, p *ProxyHandler) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	chunk := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i != b.N; i++ {
+		_, err := conn.Write(chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnectBulk(b *testing.B) {
+	benchmarkConnectBulk(b, &ProxyHandler{})
+}
+
+func BenchmarkConnectBulkBuffered(b *testing.B) {
+	benchmarkConnectBulk(b, &ProxyHandler{
+		// Hiding *net.TCPConn disables splicing.
+		ProxyDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return struct{ net.Conn }{conn}, nil
+		},
+	})
+}
+
 func BenchmarkProxy(b *testing.B) {
 	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "check", r.RequestURI)
@@ -455,3 +556,66 @@ func TestSimpleServer(t *testing.T) {
 	}
 	resp.Body.Close()
 }
+
+func TestUpstream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ProxyAuthorizationKey) != "" {
+			http.Error(w, "leaked credentials", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "check", r.RequestURI)
+	}))
+	defer target.Close()
+
+	parent := httptest.NewServer(&ProxyHandler{Authentication: BasicAuth("parent", "password")})
+	defer parent.Close()
+	u, _ := url.Parse(parent.URL)
+	u.User = url.UserPassword("parent", "password")
+	upstream, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("username", "password"),
+		Upstream:       upstream,
+	})
+	defer proxy.Close()
+	purl, _ := url.Parse(proxy.URL)
+	purl.User = url.UserPassword("username", "password")
+	dialer, err := NewDialer(purl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]*http.Client{
+		"connect": {Transport: &http.Transport{DialContext: dialer.DialContext}},
+		"proxy":   {Transport: &http.Transport{Proxy: http.ProxyURL(purl)}},
+	}
+	for name, cli := range clients {
+		t.Run(name, func(t *testing.T) {
+			resp, err := cli.Get(target.URL + "/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(body), "/"+name) {
+				t.Fatal(string(body))
+			}
+		})
+	}
+
+	upstream.Userinfo = url.UserPassword("parent", "wrong")
+	resp, err := clients["proxy"].Get(target.URL + "/proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatal("request bypassed the upstream", resp.StatusCode)
+	}
+}
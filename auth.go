@@ -1,6 +1,7 @@
 package httpproxy
 
 import (
+	"context"
 	"encoding/base64"
 	"net/http"
 	"net/url"
@@ -73,3 +74,16 @@ func basicAuth(u *url.Userinfo) (base string) {
 
 	return prefix + base
 }
+
+type identityContextKey struct{}
+
+// ContextWithIdentity returns a copy of ctx carrying the identity of the client.
+func ContextWithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext returns the identity of the client, empty if anonymous.
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityContextKey{}).(string)
+	return identity
+}
@@ -0,0 +1,277 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a circuit.
+type CircuitState int
+
+const (
+	// CircuitClosed lets calls through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects calls until the open timeout elapses.
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probes through.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// Outcome is the result of a call guarded by a CircuitBreaker.
+type Outcome int
+
+const (
+	// OutcomeSuccess closes a half-open circuit and resets the failures.
+	OutcomeSuccess Outcome = iota
+	// OutcomeFailure counts towards opening the circuit.
+	OutcomeFailure
+	// OutcomeIgnored tells nothing about the health of the key.
+	OutcomeIgnored
+)
+
+const (
+	// DefaultFailureThreshold is the default number of consecutive failures that opens a circuit.
+	DefaultFailureThreshold = 5
+	// DefaultOpenTimeout is the default time a circuit stays open before probing.
+	DefaultOpenTimeout = 30 * time.Second
+	// DefaultFailureWindow is the default time after which the failures of a closed circuit are forgotten.
+	DefaultFailureWindow = time.Minute
+)
+
+// CircuitOpenError is returned for calls rejected by an open circuit.
+type CircuitOpenError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s", e.Key)
+}
+
+// CircuitBreaker fails fast for keys whose calls keep failing.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failures that opens a circuit, DefaultFailureThreshold if zero
+	FailureThreshold int
+	// OpenTimeout is the time a circuit stays open before probing, DefaultOpenTimeout if zero
+	OpenTimeout time.Duration
+	// FailureWindow is the time after the last failure when the failures of a closed circuit are forgotten,
+	// and after the open timeout when an unused open circuit is forgotten, DefaultFailureWindow if zero
+	FailureWindow time.Duration
+	// HalfOpenProbes is the number of concurrent probes of a half-open circuit, 1 if zero
+	HalfOpenProbes int
+	// Logger logs the state changes
+	Logger *slog.Logger
+
+	mut      sync.Mutex
+	circuits map[string]*circuit
+	swept    time.Time
+	opened   uint64
+	rejected uint64
+}
+
+type circuit struct {
+	state       CircuitState
+	failures    int
+	lastFailure time.Time
+	openedAt    time.Time
+	probes      int
+}
+
+// CircuitMetrics is a snapshot of a circuit.
+type CircuitMetrics struct {
+	Key      string
+	State    CircuitState
+	Failures int
+}
+
+// Allow reports whether a call for key may proceed,
+// done must be called once with the outcome of the call.
+func (b *CircuitBreaker) Allow(key string) (done func(Outcome), err error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	c := b.circuits[key]
+	if c == nil {
+		return func(o Outcome) { b.done(key, false, o) }, nil
+	}
+	now := time.Now()
+	if c.state == CircuitOpen {
+		if wait := c.openedAt.Add(b.openTimeout()).Sub(now); wait > 0 {
+			b.rejected++
+			return nil, &CircuitOpenError{Key: key, RetryAfter: wait}
+		}
+		b.setState(key, c, CircuitHalfOpen)
+	}
+	if c.state == CircuitHalfOpen {
+		if c.probes >= b.halfOpenProbes() {
+			b.rejected++
+			return nil, &CircuitOpenError{Key: key, RetryAfter: time.Second}
+		}
+		c.probes++
+		return func(o Outcome) { b.done(key, true, o) }, nil
+	}
+	return func(o Outcome) { b.done(key, false, o) }, nil
+}
+
+func (b *CircuitBreaker) done(key string, probe bool, o Outcome) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	c := b.circuits[key]
+	if c != nil && probe {
+		c.probes--
+	}
+	switch o {
+	case OutcomeSuccess:
+		if c == nil {
+			return
+		}
+		if c.state == CircuitHalfOpen {
+			b.setState(key, c, CircuitClosed)
+		}
+		if c.state == CircuitClosed {
+			// Forget healthy keys to keep the map small.
+			delete(b.circuits, key)
+		}
+	case OutcomeFailure:
+		now := time.Now()
+		b.sweep(now)
+		c = b.circuits[key]
+		if c == nil {
+			if b.circuits == nil {
+				b.circuits = map[string]*circuit{}
+			}
+			c = &circuit{}
+			b.circuits[key] = c
+		} else if c.state == CircuitClosed && now.Sub(c.lastFailure) > b.failureWindow() {
+			c.failures = 0
+		}
+		c.failures++
+		c.lastFailure = now
+		switch c.state {
+		case CircuitHalfOpen:
+			b.open(key, c)
+		case CircuitClosed:
+			if c.failures >= b.failureThreshold() {
+				b.open(key, c)
+			}
+		}
+	}
+}
+
+// sweep forgets the expired circuits, at most once per failure window.
+func (b *CircuitBreaker) sweep(now time.Time) {
+	window := b.failureWindow()
+	if now.Sub(b.swept) < window {
+		return
+	}
+	b.swept = now
+	for key, c := range b.circuits {
+		if b.expired(c, now) {
+			delete(b.circuits, key)
+		}
+	}
+}
+
+// expired reports whether c tells nothing about the health of its key anymore.
+func (b *CircuitBreaker) expired(c *circuit, now time.Time) bool {
+	window := b.failureWindow()
+	if c.state == CircuitClosed {
+		return now.Sub(c.lastFailure) > window
+	}
+	return c.probes == 0 && now.Sub(c.openedAt) > b.openTimeout()+window
+}
+
+func (b *CircuitBreaker) open(key string, c *circuit) {
+	c.openedAt = time.Now()
+	b.opened++
+	b.setState(key, c, CircuitOpen)
+}
+
+func (b *CircuitBreaker) setState(key string, c *circuit, state CircuitState) {
+	if c.state == state {
+		return
+	}
+	if b.Logger != nil {
+		level := slog.LevelInfo
+		if state == CircuitOpen {
+			level = slog.LevelWarn
+		}
+		b.Logger.Log(context.Background(), level, "circuit state changed", "key", key, "from", c.state, "to", state)
+	}
+	c.state = state
+	if state == CircuitClosed {
+		c.failures = 0
+	}
+}
+
+// State returns the state of the circuit of key.
+func (b *CircuitBreaker) State(key string) CircuitState {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	c := b.circuits[key]
+	if c == nil {
+		return CircuitClosed
+	}
+	return c.state
+}
+
+// Metrics returns the circuits with failures and the number of times
+// circuits were opened and calls were rejected.
+func (b *CircuitBreaker) Metrics() (circuits []CircuitMetrics, opened, rejected uint64) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for key, c := range b.circuits {
+		circuits = append(circuits, CircuitMetrics{
+			Key:      key,
+			State:    c.state,
+			Failures: c.failures,
+		})
+	}
+	sort.Slice(circuits, func(i, j int) bool {
+		return circuits[i].Key < circuits[j].Key
+	})
+	return circuits, b.opened, b.rejected
+}
+
+func (b *CircuitBreaker) failureThreshold() int {
+	if b.FailureThreshold > 0 {
+		return b.FailureThreshold
+	}
+	return DefaultFailureThreshold
+}
+
+func (b *CircuitBreaker) openTimeout() time.Duration {
+	if b.OpenTimeout > 0 {
+		return b.OpenTimeout
+	}
+	return DefaultOpenTimeout
+}
+
+func (b *CircuitBreaker) failureWindow() time.Duration {
+	if b.FailureWindow > 0 {
+		return b.FailureWindow
+	}
+	return DefaultFailureWindow
+}
+
+func (b *CircuitBreaker) halfOpenProbes() int {
+	if b.HalfOpenProbes > 0 {
+		return b.HalfOpenProbes
+	}
+	return 1
+}
@@ -0,0 +1,206 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &CircuitBreaker{
+		FailureThreshold: 2,
+		OpenTimeout:      50 * time.Millisecond,
+	}
+	fail := func() {
+		done, err := b.Allow("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(OutcomeFailure)
+	}
+
+	fail()
+	if b.State("key") != CircuitClosed {
+		t.Fatal(b.State("key"))
+	}
+	fail()
+	if b.State("key") != CircuitOpen {
+		t.Fatal(b.State("key"))
+	}
+	_, err := b.Allow("key")
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.RetryAfter <= 0 {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	done, err := b.Allow("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.State("key") != CircuitHalfOpen {
+		t.Fatal(b.State("key"))
+	}
+	if _, err := b.Allow("key"); err == nil {
+		t.Fatal("second probe allowed")
+	}
+	done(OutcomeFailure)
+	if b.State("key") != CircuitOpen {
+		t.Fatal(b.State("key"))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	done, err = b.Allow("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(OutcomeSuccess)
+	if b.State("key") != CircuitClosed {
+		t.Fatal(b.State("key"))
+	}
+
+	_, opened, rejected := b.Metrics()
+	if opened != 2 || rejected != 2 {
+		t.Fatal(opened, rejected)
+	}
+}
+
+func TestCircuitBreakerExpiry(t *testing.T) {
+	b := &CircuitBreaker{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Millisecond,
+		FailureWindow:    20 * time.Millisecond,
+	}
+	fail := func(key string) {
+		done, err := b.Allow(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(OutcomeFailure)
+	}
+
+	fail("once")
+	fail("open")
+	fail("open")
+	fail("window")
+	time.Sleep(50 * time.Millisecond)
+
+	// Failures further apart than the window are not consecutive.
+	fail("window")
+	if b.State("window") != CircuitClosed {
+		t.Fatal(b.State("window"))
+	}
+	circuits, _, _ := b.Metrics()
+	if len(circuits) != 1 || circuits[0].Key != "window" || circuits[0].Failures != 1 {
+		t.Fatal("expired circuits kept", circuits)
+	}
+}
+
+func TestCircuitBreakerDialTimeout(t *testing.T) {
+	proxy := httptest.NewServer(&ProxyHandler{
+		CircuitBreaker: &CircuitBreaker{FailureThreshold: 2},
+		DialTimeout:    20 * time.Millisecond,
+		ProxyDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var codes []int
+	for i := 0; i != 3; i++ {
+		_, err = dialer.Dial("tcp", "example.com:443")
+		var connectErr *ConnectError
+		if !errors.As(err, &connectErr) {
+			t.Fatal(err)
+		}
+		codes = append(codes, connectErr.StatusCode)
+	}
+	if codes[1] == http.StatusServiceUnavailable || codes[2] != http.StatusServiceUnavailable {
+		t.Fatal("timeouts do not open the circuit", codes)
+	}
+}
+
+func TestCircuitBreakerProxyStatus(t *testing.T) {
+	dead := strings.TrimPrefix(deadProxyURL(t), "http://")
+	proxy := httptest.NewServer(&ProxyHandler{
+		CircuitBreaker: &CircuitBreaker{FailureThreshold: 1},
+	})
+	defer proxy.Close()
+	purl, _ := url.Parse(proxy.URL)
+
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dialer.Dial("tcp", dead)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || connectErr.StatusCode != http.StatusInternalServerError {
+		t.Fatal(err)
+	}
+	_, err = dialer.Dial("tcp", dead)
+	if !errors.As(err, &connectErr) || connectErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(err)
+	}
+
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(purl)}}
+	resp, err := cli.Get("http://" + dead + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(resp.Status)
+	}
+	if status := resp.Header.Get(ProxyStatusKey); !strings.Contains(status, "error=destination_unavailable") {
+		t.Fatal(status)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After")
+	}
+}
+
+func TestCircuitBreakerUpstreamRequest(t *testing.T) {
+	upstream, err := NewDialer(deadProxyURL(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker := &CircuitBreaker{FailureThreshold: 1}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Upstream:       upstream,
+		CircuitBreaker: breaker,
+	})
+	defer proxy.Close()
+	purl, _ := url.Parse(proxy.URL)
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(purl)}}
+
+	var codes []int
+	for i := 0; i != 2; i++ {
+		resp, err := cli.Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+		if i == 1 && !strings.Contains(resp.Header.Get(ProxyStatusKey), "error=destination_unavailable") {
+			t.Fatal("missing Proxy-Status", resp.Header)
+		}
+	}
+	if codes[0] != http.StatusInternalServerError || codes[1] != http.StatusServiceUnavailable {
+		t.Fatal("upstream failures do not open the circuit", codes)
+	}
+	circuits, _, _ := breaker.Metrics()
+	if len(circuits) != 1 || circuits[0].Key != "upstream:"+upstream.Proxy {
+		t.Fatal(circuits)
+	}
+}
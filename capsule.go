@@ -0,0 +1,163 @@
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// CapsuleProtocolKey is the header that indicates the capsule protocol (RFC 9297) is in use.
+	CapsuleProtocolKey = "Capsule-Protocol"
+
+	// capsuleTypeDatagram is the DATAGRAM capsule type (RFC 9297).
+	capsuleTypeDatagram = 0x00
+
+	// maxCapsuleLength bounds the length of a capsule that will be read into memory.
+	maxCapsuleLength = 1<<16 + 16
+
+	// maxVarint is the largest value a QUIC variable-length integer can hold.
+	maxVarint = 1<<62 - 1
+)
+
+var errCapsuleTooLarge = errors.New("capsule too large")
+
+// appendVarint appends a QUIC variable-length integer (RFC 9000 Section 16).
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	case v < 1<<30:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	case v <= maxVarint:
+		return binary.BigEndian.AppendUint64(b, v|0xc000000000000000)
+	}
+	panic(fmt.Sprintf("varint %d overflow", v))
+}
+
+// readVarint reads a QUIC variable-length integer.
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		b, err = r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// parseVarint parses a QUIC variable-length integer from the start of b.
+func parseVarint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, nil
+}
+
+// capsuleReader reads capsules (RFC 9297 Section 3.2) from a stream.
+type capsuleReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newCapsuleReader(r io.Reader) *capsuleReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &capsuleReader{r: br}
+}
+
+// ReadCapsule returns the type and value of the next capsule,
+// the value is only valid until the next call.
+func (c *capsuleReader) ReadCapsule() (uint64, []byte, error) {
+	typ, err := readVarint(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarint(c.r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	if length > maxCapsuleLength {
+		return 0, nil, errCapsuleTooLarge
+	}
+	if cap(c.buf) < int(length) {
+		c.buf = make([]byte, length)
+	}
+	value := c.buf[:length]
+	_, err = io.ReadFull(c.r, value)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return typ, value, nil
+}
+
+// ReadDatagram returns the payload of the next DATAGRAM capsule that carries
+// context ID zero, skipping any other capsule.
+func (c *capsuleReader) ReadDatagram() ([]byte, error) {
+	for {
+		typ, value, err := c.ReadCapsule()
+		if err != nil {
+			return nil, err
+		}
+		if typ != capsuleTypeDatagram {
+			continue
+		}
+		contextID, n, err := parseVarint(value)
+		if err != nil {
+			return nil, err
+		}
+		if contextID != 0 {
+			continue
+		}
+		return value[n:], nil
+	}
+}
+
+// appendCapsule appends a capsule with the given type and value.
+func appendCapsule(b []byte, typ uint64, value ...[]byte) []byte {
+	length := 0
+	for _, v := range value {
+		length += len(v)
+	}
+	b = appendVarint(b, typ)
+	b = appendVarint(b, uint64(length))
+	for _, v := range value {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// appendDatagram appends a DATAGRAM capsule with context ID zero.
+func appendDatagram(b []byte, payload []byte) []byte {
+	return appendCapsule(b, capsuleTypeDatagram, []byte{0}, payload)
+}
@@ -0,0 +1,86 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// HopError is returned when a hop of a ChainDialer fails.
+type HopError struct {
+	// Hop is the index of the failed hop
+	Hop int
+	// Proxy is the address of the failed hop
+	Proxy string
+	Err   error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("hop %d (%s): %v", e.Hop, e.Proxy, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// NewChainDialer is create a dialer that CONNECTs through the proxies in order,
+// each hop is configured like NewDialer.
+func NewChainDialer(addrs ...string) (*ChainDialer, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no proxy in chain")
+	}
+	c := &ChainDialer{}
+	for i, addr := range addrs {
+		d, err := NewDialer(addr)
+		if err != nil {
+			return nil, fmt.Errorf("hop %d: %w", i, err)
+		}
+		c.Hops = append(c.Hops, d)
+	}
+	return c, nil
+}
+
+// ChainDialer CONNECTs hop by hop through a chain of proxies.
+type ChainDialer struct {
+	// Hops are the proxies in order, the ProxyDial of the first hop
+	// establishes the transport connection, that of the others is unused
+	Hops []*Dialer
+}
+
+// DialContext connects to the provided address on the provided network.
+func (c *ChainDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(c.Hops) == 0 {
+		return nil, errors.New("no proxy in chain")
+	}
+	first := c.Hops[0]
+	conn, err := first.proxyDial(ctx, network, first.Proxy)
+	if err != nil {
+		return nil, &HopError{Hop: 0, Proxy: first.Proxy, Err: err}
+	}
+	for i, hop := range c.Hops {
+		target := address
+		if i+1 < len(c.Hops) {
+			target = c.Hops[i+1].Proxy
+		}
+		tunnel, err := hop.connect(ctx, conn, target)
+		if err != nil {
+			conn.Close()
+			return nil, &HopError{Hop: i, Proxy: hop.Proxy, Err: err}
+		}
+		conn = tunnel
+		if i+1 < len(c.Hops) {
+			next := c.Hops[i+1]
+			conn, err = next.handshake(ctx, conn)
+			if err != nil {
+				return nil, &HopError{Hop: i + 1, Proxy: next.Proxy, Err: err}
+			}
+		}
+	}
+	return conn, nil
+}
+
+// Dial connects to the provided address on the provided network.
+func (c *ChainDialer) Dial(network string, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
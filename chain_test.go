@@ -0,0 +1,60 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestChainDialer(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer target.Close()
+
+	hop0 := httptest.NewServer(&ProxyHandler{Authentication: BasicAuth("u0", "p0")})
+	defer hop0.Close()
+	hop1 := httptest.NewTLSServer(&ProxyHandler{})
+	defer hop1.Close()
+	hop2 := httptest.NewServer(&ProxyHandler{Authentication: BasicAuth("u2", "p2")})
+	defer hop2.Close()
+
+	withUser := func(raw string, user *url.Userinfo) string {
+		u, _ := url.Parse(raw)
+		u.User = user
+		return u.String()
+	}
+	chain, err := NewChainDialer(
+		withUser(hop0.URL, url.UserPassword("u0", "p0")),
+		hop1.URL,
+		withUser(hop2.URL, url.UserPassword("u2", "p2")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Hops[1].TLSClientConfig.InsecureSkipVerify = true
+
+	cli := &http.Client{Transport: &http.Transport{DialContext: chain.DialContext}}
+	resp, err := cli.Get(target.URL + "/chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasSuffix(strings.TrimSpace(string(body)), "/chain") {
+		t.Fatal(string(body))
+	}
+
+	chain.Hops[2].Userinfo = url.UserPassword("u2", "wrong")
+	_, err = chain.Dial("tcp", target.Listener.Addr().String())
+	var hopErr *HopError
+	if !errors.As(err, &hopErr) || hopErr.Hop != 2 {
+		t.Fatal(err)
+	}
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || connectErr.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatal(err)
+	}
+}
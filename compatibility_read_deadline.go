@@ -46,6 +46,15 @@ type connCompatibilityReadDeadline struct {
 	net.Conn
 }
 
+func (d connCompatibilityReadDeadline) netConn() net.Conn {
+	return d.Conn
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (d connCompatibilityReadDeadline) CloseWrite() error {
+	return closeWrite(d.Conn)
+}
+
 func (d connCompatibilityReadDeadline) SetReadDeadline(t time.Time) error {
 	if aLongTimeAgo == t {
 		t = time.Now().Add(1 * time.Second)
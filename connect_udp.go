@@ -0,0 +1,477 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultUDPURITemplate is the default URI template for CONNECT-UDP (RFC 9298).
+	DefaultUDPURITemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+
+	// connectUDPProtocol is the upgrade token of CONNECT-UDP.
+	connectUDPProtocol = "connect-udp"
+
+	// maxUDPPayload is the largest UDP payload.
+	maxUDPPayload = 1<<16 - 1
+)
+
+// isConnectUDP reports whether r is an HTTP/1.1 CONNECT-UDP request.
+func isConnectUDP(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerContainsToken(r.Header["Connection"], "upgrade") &&
+		headerContainsToken(r.Header["Upgrade"], connectUDPProtocol)
+}
+
+// headerContainsToken reports whether any of the comma-separated values contains token.
+func headerContainsToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *ProxyHandler) udpURITemplate() string {
+	if p.UDPURITemplate != "" {
+		return p.UDPURITemplate
+	}
+	return DefaultUDPURITemplate
+}
+
+// proxyConnectUDP handles CONNECT-UDP over HTTP/1.1 Upgrade or HTTP/2 extended CONNECT.
+func (p *ProxyHandler) proxyConnectUDP(w http.ResponseWriter, r *http.Request) {
+	host, port, ok := matchUDPURITemplate(p.udpURITemplate(), r.URL)
+	if !ok {
+		e := fmt.Sprintf("invalid connect-udp target %q", r.URL.RequestURI())
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok && r.ProtoMajor != 2 {
+		e := "not support"
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	address := net.JoinHostPort(host, port)
+	targetConn, err := p.proxyDial(r.Context(), "udp", address)
+	if err != nil {
+		p.recordRequest(r.Context(), address, 0, 0, err)
+		if p.circuitOpen(w, err) {
+			return
+		}
+		e := fmt.Sprintf("dial %q failed: %v", address, err)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	var clientConn io.ReadWriteCloser
+	if r.ProtoMajor == 2 {
+		w.Header().Set(CapsuleProtocolKey, "?1")
+		w.WriteHeader(http.StatusOK)
+		clientConn, err = newStreamConn(w, r)
+		if err != nil {
+			if p.Logger != nil {
+				p.Logger.Error("open stream failed", "err", err)
+			}
+			return
+		}
+	} else {
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			e := fmt.Sprintf("hijack failed: %v", err)
+			if p.Logger != nil {
+				p.Logger.Error(e)
+			}
+			http.Error(w, e, http.StatusInternalServerError)
+			return
+		}
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		rw.WriteString("Connection: Upgrade\r\n")
+		rw.WriteString("Upgrade: " + connectUDPProtocol + "\r\n")
+		rw.WriteString(CapsuleProtocolKey + ": ?1\r\n\r\n")
+		clientConn = newBufConn(conn, rw)
+	}
+
+	if p.Observer != nil {
+		p.Observer.TunnelEstablished(r, address)
+	}
+	start := time.Now()
+	result := p.relayDatagrams(r.Context(), targetConn, clientConn)
+	p.tunnelDone(r, address, start, result)
+}
+
+// relayDatagrams relays between a connected UDP socket and a capsule stream,
+// the bytes of the result are the payload bytes. TunnelIdleTimeout,
+// TunnelMaxDuration and the Shaper apply like to tunnels.
+func (p *ProxyHandler) relayDatagrams(ctx context.Context, packetConn net.Conn, stream io.ReadWriteCloser) tunnelResult {
+	var shaped *shapedConn
+	if p.Shaper != nil {
+		shaped = p.Shaper.open(IdentityFromContext(ctx))
+	}
+	var maxDuration <-chan time.Time
+	if p.TunnelMaxDuration > 0 {
+		timer := time.NewTimer(p.TunnelMaxDuration)
+		defer timer.Stop()
+		maxDuration = timer.C
+	}
+	var activity atomic.Int64
+	var idleC <-chan time.Time
+	var idle *time.Timer
+	if p.TunnelIdleTimeout > 0 {
+		activity.Store(time.Now().UnixNano())
+		idle = time.NewTimer(p.TunnelIdleTimeout)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+
+	type copied struct {
+		upload bool
+		tunnelDirection
+	}
+	ch := make(chan copied, 2)
+	go func() {
+		var n int64
+		r := newCapsuleReader(stream)
+		for {
+			payload, err := r.ReadDatagram()
+			if err == nil && shaped != nil {
+				err = shaped.waitUpload(len(payload))
+			}
+			if err != nil {
+				ch <- copied{true, tunnelDirection{n, err}}
+				return
+			}
+			_, err = packetConn.Write(payload)
+			if err != nil && !isTransientUDPError(err) {
+				ch <- copied{true, tunnelDirection{n, err}}
+				return
+			}
+			activity.Store(time.Now().UnixNano())
+			n += int64(len(payload))
+		}
+	}()
+	go func() {
+		var n int64
+		buf := make([]byte, maxUDPPayload)
+		var out []byte
+		for {
+			m, err := packetConn.Read(buf)
+			if err != nil {
+				if isTransientUDPError(err) {
+					continue
+				}
+				ch <- copied{false, tunnelDirection{n, err}}
+				return
+			}
+			if shaped != nil {
+				err = shaped.waitDownload(m)
+				if err != nil {
+					ch <- copied{false, tunnelDirection{n, err}}
+					return
+				}
+			}
+			out = appendDatagram(out[:0], buf[:m])
+			_, err = stream.Write(out)
+			if err != nil {
+				ch <- copied{false, tunnelDirection{n, err}}
+				return
+			}
+			activity.Store(time.Now().UnixNano())
+			n += int64(m)
+		}
+	}()
+
+	var result tunnelResult
+	closed := false
+	closeBoth := func() {
+		if !closed {
+			closed = true
+			_ = packetConn.Close()
+			_ = stream.Close()
+			if shaped != nil {
+				shaped.close()
+			}
+		}
+	}
+	defer closeBoth()
+
+	done := ctx.Done()
+	// Both directions are waited for, so their bytes are complete.
+	for pending := 2; pending > 0; {
+		select {
+		case c := <-ch:
+			pending--
+			// The end of the stream closes the association, the errors
+			// after the first are caused by closing.
+			if closed || c.Err == io.EOF || isClosedErr(c.Err) {
+				c.Err = nil
+			}
+			if c.upload {
+				result.Upload = c.tunnelDirection
+			} else {
+				result.Download = c.tunnelDirection
+			}
+			closeBoth()
+		case <-idleC:
+			if d := time.Since(time.Unix(0, activity.Load())); d < p.TunnelIdleTimeout {
+				idle.Reset(p.TunnelIdleTimeout - d)
+				continue
+			}
+			idleC = nil
+			if !closed {
+				result.Timeout = errTunnelIdleTimeout
+			}
+			closeBoth()
+		case <-maxDuration:
+			maxDuration = nil
+			if !closed {
+				result.Timeout = errTunnelMaxDuration
+			}
+			closeBoth()
+		case <-done:
+			done = nil
+			closeBoth()
+		}
+	}
+	return result
+}
+
+// isTransientUDPError reports whether err is an ICMP error reported on a
+// connected UDP socket, which should not end the association.
+func isTransientUDPError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// matchUDPURITemplate extracts the target from a request URL using template.
+// Variables may form whole path segments or query values.
+func matchUDPURITemplate(template string, u *url.URL) (host, port string, ok bool) {
+	tpath, tquery, _ := strings.Cut(template, "?")
+	vars := map[string]string{}
+
+	tsegs := strings.Split(tpath, "/")
+	segs := strings.Split(u.EscapedPath(), "/")
+	if len(tsegs) != len(segs) {
+		return "", "", false
+	}
+	for i, tseg := range tsegs {
+		name, isVar := templateVariable(tseg)
+		if !isVar {
+			if tseg != segs[i] {
+				return "", "", false
+			}
+			continue
+		}
+		v, err := url.PathUnescape(segs[i])
+		if err != nil {
+			return "", "", false
+		}
+		vars[name] = v
+	}
+
+	if tquery != "" {
+		query := u.Query()
+		for _, kv := range strings.Split(tquery, "&") {
+			k, tv, _ := strings.Cut(kv, "=")
+			name, isVar := templateVariable(tv)
+			if !isVar {
+				if query.Get(k) != tv {
+					return "", "", false
+				}
+				continue
+			}
+			vars[name] = query.Get(k)
+		}
+	}
+
+	host, port = vars["target_host"], vars["target_port"]
+	if host == "" || port == "" {
+		return "", "", false
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return "", "", false
+	}
+	return host, port, true
+}
+
+// expandUDPURITemplate expands template with the target.
+func expandUDPURITemplate(template, host, port string) string {
+	// The colons of IPv6 addresses are percent-encoded (RFC 9298 Section 2).
+	escapedHost := strings.ReplaceAll(url.PathEscape(host), ":", "%3A")
+	return strings.NewReplacer(
+		"{target_host}", escapedHost,
+		"{target_port}", url.PathEscape(port),
+	).Replace(template)
+}
+
+func templateVariable(s string) (string, bool) {
+	if len(s) < 3 || s[0] != '{' || s[len(s)-1] != '}' {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
+
+// DialUDPContext proxies UDP to the provided address using CONNECT-UDP (RFC 9298).
+// The returned connection is connected to address and also implements net.Conn.
+func (d *Dialer) DialUDPContext(ctx context.Context, network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.proxyDial(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	template := d.UDPURITemplate
+	if template == "" {
+		template = DefaultUDPURITemplate
+	}
+	target, err := url.ParseRequestURI(expandUDPURITemplate(template, host, port))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	hdr := d.proxyHeader().Clone()
+	hdr.Set("Connection", "Upgrade")
+	hdr.Set("Upgrade", connectUDPProtocol)
+	hdr.Set(CapsuleProtocolKey, "?1")
+	upgradeReq := &http.Request{
+		Method: http.MethodGet,
+		URL:    target,
+		Host:   d.Proxy,
+		Header: hdr,
+	}
+
+	resp, br, err := d.roundTrip(ctx, conn, upgradeReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, &ConnectError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var remoteAddr net.Addr
+	if ap, err := netip.ParseAddrPort(address); err == nil {
+		remoteAddr = net.UDPAddrFromAddrPort(ap)
+	} else {
+		remoteAddr = &hostPortAddr{network: network, address: address}
+	}
+	return &connectUDPConn{
+		Conn:       conn,
+		r:          newCapsuleReader(br),
+		remoteAddr: remoteAddr,
+	}, nil
+}
+
+// DialUDP proxies UDP to the provided address using CONNECT-UDP (RFC 9298).
+func (d *Dialer) DialUDP(network, address string) (net.PacketConn, error) {
+	return d.DialUDPContext(context.Background(), network, address)
+}
+
+// hostPortAddr is a net.Addr for a target which has not been resolved.
+type hostPortAddr struct {
+	network string
+	address string
+}
+
+func (a *hostPortAddr) Network() string {
+	return a.network
+}
+
+func (a *hostPortAddr) String() string {
+	return a.address
+}
+
+// connectUDPConn is a UDP association proxied with CONNECT-UDP.
+type connectUDPConn struct {
+	net.Conn
+	remoteAddr net.Addr
+
+	rmut sync.Mutex
+	r    *capsuleReader
+
+	wmut sync.Mutex
+	wbuf []byte
+}
+
+func (c *connectUDPConn) Read(p []byte) (int, error) {
+	c.rmut.Lock()
+	defer c.rmut.Unlock()
+	payload, err := c.r.ReadDatagram()
+	if err != nil {
+		return 0, err
+	}
+	// Like UDP, excess bytes are discarded.
+	return copy(p, payload), nil
+}
+
+func (c *connectUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, c.remoteAddr, nil
+}
+
+func (c *connectUDPConn) Write(p []byte) (int, error) {
+	if len(p) > maxUDPPayload {
+		return 0, &net.OpError{Op: "write", Net: c.remoteAddr.Network(), Addr: c.remoteAddr, Err: syscall.EMSGSIZE}
+	}
+	c.wmut.Lock()
+	defer c.wmut.Unlock()
+	c.wbuf = appendDatagram(c.wbuf[:0], p)
+	_, err := c.Conn.Write(c.wbuf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *connectUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr != nil && addr.String() != c.remoteAddr.String() {
+		return 0, &net.OpError{Op: "write", Net: c.remoteAddr.Network(), Addr: addr, Err: net.ErrWriteToConnected}
+	}
+	return c.Write(p)
+}
+
+func (c *connectUDPConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
@@ -0,0 +1,206 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func udpEchoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestConnectUDP(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+
+	proxy := httptest.NewServer(&ProxyHandler{Authentication: BasicAuth("username", "password")})
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("username", "password")
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.DialUDP("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, msg := range []string{"ping", "", "pong"} {
+		_, err = conn.WriteTo([]byte(msg), echo.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatal(string(buf[:n]))
+		}
+		if addr.String() != echo.LocalAddr().String() {
+			t.Fatal(addr)
+		}
+	}
+}
+
+func TestConnectUDPH2(t *testing.T) {
+	if !withExtendedConnect(t) {
+		return
+	}
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	proxy := h2cServer(&ProxyHandler{})
+	defer proxy.Server.Close()
+
+	host, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	addr := proxy.Listener.Addr().String()
+	stream := extendedConnect(t, addr, connectUDPProtocol, addr, expandUDPURITemplate(DefaultUDPURITemplate, host, port), http.Header{
+		CapsuleProtocolKey: []string{"?1"},
+	})
+	defer stream.Close()
+	if stream.Status != http.StatusOK {
+		t.Fatal(stream.Status)
+	}
+	if stream.Header.Get(CapsuleProtocolKey) != "?1" {
+		t.Fatal(stream.Header)
+	}
+
+	r := newCapsuleReader(stream)
+	for _, msg := range []string{"ping", "", "pong"} {
+		// Unknown capsules are skipped.
+		out := appendCapsule(nil, 0x2a, []byte("ignored"))
+		out = appendDatagram(out, []byte(msg))
+		_, err := stream.Write(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := r.ReadDatagram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != msg {
+			t.Fatal(string(payload))
+		}
+	}
+}
+
+func TestMatchUDPURITemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		host     string
+		port     string
+	}{
+		{DefaultUDPURITemplate, "192.0.2.6", "443"},
+		{DefaultUDPURITemplate, "2001:db8::42", "53"},
+		{DefaultUDPURITemplate, "example.com", "8443"},
+		{"/masque?h={target_host}&p={target_port}", "2001:db8::42", "53"},
+	}
+	for _, tt := range tests {
+		u, err := url.ParseRequestURI(expandUDPURITemplate(tt.template, tt.host, tt.port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, port, ok := matchUDPURITemplate(tt.template, u)
+		if !ok || host != tt.host || port != tt.port {
+			t.Fatal(u, host, port, ok)
+		}
+	}
+
+	u, _ := url.ParseRequestURI("/.well-known/masque/udp/example.com/0/")
+	if _, _, ok := matchUDPURITemplate(DefaultUDPURITemplate, u); ok {
+		t.Fatal("port 0 accepted")
+	}
+}
+
+// relayDatagramsPair starts relaying between a UDP socket connected to echo
+// and a capsule stream, it returns the client side of the stream.
+func relayDatagramsPair(t *testing.T, p *ProxyHandler, echo net.PacketConn) (net.Conn, <-chan tunnelResult) {
+	target, err := net.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, stream := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	done := make(chan tunnelResult, 1)
+	go func() {
+		done <- p.relayDatagrams(context.Background(), target, stream)
+	}()
+	go io.Copy(io.Discard, client)
+	return client, done
+}
+
+func TestConnectUDPIdleTimeout(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	p := &ProxyHandler{TunnelIdleTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	client, done := relayDatagramsPair(t, p, echo)
+
+	// Datagrams keep the association open.
+	ping := appendDatagram(nil, []byte("ping"))
+	for i := 0; i != 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		client.Write(ping)
+	}
+
+	select {
+	case result := <-done:
+		if result.Timeout != errTunnelIdleTimeout {
+			t.Fatal(result.Err())
+		}
+		if time.Since(start) < 250*time.Millisecond {
+			t.Fatal("closed despite traffic")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle association was not closed")
+	}
+}
+
+func TestConnectUDPMaxDuration(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	p := &ProxyHandler{TunnelMaxDuration: 100 * time.Millisecond}
+	client, done := relayDatagramsPair(t, p, echo)
+
+	ping := appendDatagram(nil, []byte("ping"))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case result := <-done:
+			if result.Timeout != errTunnelMaxDuration {
+				t.Fatal(result.Err())
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			client.Write(ping)
+		case <-timeout:
+			t.Fatal("association outlived its maximum duration")
+		}
+	}
+}
@@ -48,6 +48,16 @@ func NewDialer(addr string) (*Dialer, error) {
 	return d, nil
 }
 
+// ConnectError is returned when the proxy answers with an unexpected status.
+type ConnectError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("failed proxying %d: %s", e.StatusCode, e.Status)
+}
+
 // Dialer holds HTTP CONNECT options.
 type Dialer struct {
 	// ProxyDial specifies the optional dial function for
@@ -73,6 +83,9 @@ type Dialer struct {
 	// Timeout is the maximum amount of time a dial will wait for
 	// a connect to complete. The default is no timeout
 	Timeout time.Duration
+
+	// UDPURITemplate is the URI template of CONNECT-UDP, DefaultUDPURITemplate if empty
+	UDPURITemplate string
 }
 
 func (d *Dialer) proxyDial(ctx context.Context, network string, address string) (net.Conn, error) {
@@ -86,14 +99,18 @@ func (d *Dialer) proxyDial(ctx context.Context, network string, address string)
 	if err != nil {
 		return nil, err
 	}
+	return d.handshake(ctx, rawConn)
+}
 
+// handshake establishes the TLS connection to the proxy if TLSClientConfig is set.
+func (d *Dialer) handshake(ctx context.Context, rawConn net.Conn) (net.Conn, error) {
 	config := d.TLSClientConfig
 	if config == nil {
 		return rawConn, nil
 	}
 
 	conn := tls.Client(rawConn, config)
-	err = conn.Handshake()
+	err := conn.HandshakeContext(ctx)
 	if err != nil {
 		rawConn.Close()
 		return nil, err
@@ -108,6 +125,51 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		return nil, err
 	}
 
+	tunnel, err := d.connect(ctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// connect asks the proxy on conn to tunnel to address, the returned
+// connection reads the bytes of the tunnel buffered with the response.
+func (d *Dialer) connect(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: d.proxyHeader(),
+	}
+
+	resp, br, err := d.roundTrip(ctx, conn, connectReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ConnectError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	// Servers that speak first may send data right after the response.
+	if br.Buffered() > 0 {
+		return &bufConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// proxyURL returns the URL of the proxy for http.Transport. The scheme is always
+// http because proxyDial already establishes the TLS connection to the proxy.
+func (d *Dialer) proxyURL() *url.URL {
+	return &url.URL{
+		Scheme: "http",
+		Host:   d.Proxy,
+		User:   d.Userinfo,
+	}
+}
+
+// proxyHeader returns the headers to send to the proxy.
+func (d *Dialer) proxyHeader() http.Header {
 	hdr := d.ProxyHeader
 	if hdr == nil {
 		hdr = http.Header{}
@@ -116,13 +178,11 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		hdr = hdr.Clone()
 		hdr.Set(ProxyAuthorizationKey, basicAuth(d.Userinfo))
 	}
-	connectReq := &http.Request{
-		Method: http.MethodConnect,
-		URL:    &url.URL{Opaque: address},
-		Host:   address,
-		Header: hdr,
-	}
+	return hdr
+}
 
+// roundTrip writes the request to conn and reads the response.
+func (d *Dialer) roundTrip(ctx context.Context, conn net.Conn, req *http.Request) (*http.Response, *bufio.Reader, error) {
 	// If there's no done channel (no deadline or cancellation
 	// from the caller possible), at least set some (long)
 	// timeout here. This will make sure we don't block forever
@@ -138,37 +198,31 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	didReadResponse := make(chan struct{}) // closed after CONNECT write+read is done or fails
 	var (
 		resp *http.Response
+		br   *bufio.Reader
+		err  error
 	)
 	// Write the CONNECT request & read the response.
 	go func() {
 		defer close(didReadResponse)
-		err = connectReq.Write(conn)
+		err = req.Write(conn)
 		if err != nil {
 			return
 		}
-		// Okay to use and discard buffered reader here, because
-		// TLS server will not speak until spoken to.
-		br := bufio.NewReader(conn)
-		resp, err = http.ReadResponse(br, connectReq)
+		br = bufio.NewReader(conn)
+		resp, err = http.ReadResponse(br, req)
 	}()
 	select {
 	case <-connectCtx.Done():
 		conn.Close()
 		<-didReadResponse
-		return nil, connectCtx.Err()
+		return nil, nil, connectCtx.Err()
 	case <-didReadResponse:
 		// resp or err now set
 	}
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		conn.Close()
-		return nil, fmt.Errorf("failed proxying %d: %s", resp.StatusCode, resp.Status)
-	}
-	return conn, nil
+	return resp, br, nil
 }
 
 // Dial connects to the provided address on the provided network.
@@ -0,0 +1,314 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the addresses of a host, *net.Resolver implements it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// NewResolver creates a resolver that sends DNS queries to address.
+func NewResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// IPPreference selects the address families used for a destination.
+type IPPreference int
+
+const (
+	// PreferIPv6 tries IPv6 first and falls back to IPv4 (RFC 8305).
+	PreferIPv6 IPPreference = iota
+	// PreferIPv4 tries IPv4 first and falls back to IPv6.
+	PreferIPv4
+	// IPv4Only uses IPv4 exclusively.
+	IPv4Only
+	// IPv6Only uses IPv6 exclusively.
+	IPv6Only
+)
+
+const (
+	// DefaultResolutionDelay is how long to wait for AAAA records once A records arrived (RFC 8305).
+	DefaultResolutionDelay = 50 * time.Millisecond
+	// DefaultConnectionAttemptDelay is the delay between racing connection attempts (RFC 8305).
+	DefaultConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+// DirectDialer connects to destinations without a proxy, resolving them itself
+// and racing the connection attempts with Happy Eyeballs v2 (RFC 8305).
+type DirectDialer struct {
+	// Dialer is used for the connection attempts, the zero value if nil
+	Dialer *net.Dialer
+	// Resolver looks up host names, DefaultResolver if nil
+	Resolver Resolver
+	// Hosts are static overrides like /etc/hosts, looked up before the Resolver
+	Hosts map[string][]netip.Addr
+	// IPPreference selects the address families
+	IPPreference IPPreference
+	// ResolutionDelay is how long to wait for AAAA records once A records arrived, DefaultResolutionDelay if zero
+	ResolutionDelay time.Duration
+	// ConnectionAttemptDelay is the delay between racing connection attempts, DefaultConnectionAttemptDelay if zero
+	ConnectionAttemptDelay time.Duration
+	// Source selects the local address of the connections, the one set by a ProxyHandler takes precedence
+	Source *SourceAddress
+}
+
+// DialContext connects to the provided address on the provided network.
+func (d *DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.lookup(ctx, network, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if len(addrs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}}
+	}
+	targets := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		targets = append(targets, net.JoinHostPort(addr.String(), port))
+	}
+	if len(targets) == 1 || !strings.HasPrefix(network, "tcp") {
+		return d.dialTarget(ctx, network, targets[0])
+	}
+	return d.race(ctx, network, targets)
+}
+
+// Dial connects to the provided address on the provided network.
+func (d *DirectDialer) Dial(network string, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *DirectDialer) dialer() *net.Dialer {
+	if d.Dialer != nil {
+		return d.Dialer
+	}
+	return &net.Dialer{}
+}
+
+// dialTarget connects to a resolved target from the source address.
+func (d *DirectDialer) dialTarget(ctx context.Context, network, target string) (net.Conn, error) {
+	source := sourceFromContext(ctx)
+	if source == nil {
+		source = d.Source
+	}
+	if source == nil {
+		return d.dialer().DialContext(ctx, network, target)
+	}
+	return source.dial(ctx, d.dialer(), network, target)
+}
+
+func (d *DirectDialer) resolver() Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return DefaultResolver
+}
+
+// families returns the families to use in order of preference.
+func (d *DirectDialer) families(network string) (first, second string) {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return "ip4", ""
+	case strings.HasSuffix(network, "6"):
+		return "ip6", ""
+	}
+	switch d.IPPreference {
+	case IPv4Only:
+		return "ip4", ""
+	case IPv6Only:
+		return "ip6", ""
+	case PreferIPv4:
+		return "ip4", "ip6"
+	}
+	return "ip6", "ip4"
+}
+
+// lookup returns the addresses of host interleaved by family, preferred family first.
+func (d *DirectDialer) lookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	first, second := d.families(network)
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr.Unmap()}
+	} else if hosts, ok := d.Hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		addrs = hosts
+	} else {
+		return d.resolve(ctx, host, first, second)
+	}
+	firsts := filterFamily(addrs, first)
+	var seconds []netip.Addr
+	if second != "" {
+		seconds = filterFamily(addrs, second)
+	}
+	return interleave(firsts, seconds), nil
+}
+
+// resolve queries both families concurrently, once one of them answered
+// the other one is waited for at most ResolutionDelay.
+func (d *DirectDialer) resolve(ctx context.Context, host, first, second string) ([]netip.Addr, error) {
+	type result struct {
+		family string
+		addrs  []netip.Addr
+		err    error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resolver := d.resolver()
+	families := []string{first}
+	if second != "" {
+		families = append(families, second)
+	}
+	ch := make(chan result, len(families))
+	for _, family := range families {
+		go func() {
+			addrs, err := resolver.LookupNetIP(ctx, family, host)
+			ch <- result{family, filterFamily(addrs, family), err}
+		}()
+	}
+
+	delay := d.ResolutionDelay
+	if delay == 0 {
+		delay = DefaultResolutionDelay
+	}
+	var (
+		firsts, seconds []netip.Addr
+		errs            []error
+		timer           <-chan time.Time
+	)
+	for pending := len(families); pending > 0; {
+		select {
+		case res := <-ch:
+			pending--
+			if res.err != nil {
+				errs = append(errs, res.err)
+			}
+			if res.family == first {
+				firsts = res.addrs
+			} else {
+				seconds = res.addrs
+			}
+			if len(res.addrs) != 0 && pending > 0 && timer == nil {
+				timer = time.After(delay)
+			}
+		case <-timer:
+			pending = 0
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	addrs := interleave(firsts, seconds)
+	if len(addrs) == 0 && len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return addrs, nil
+}
+
+// race starts a connection attempt every ConnectionAttemptDelay, or as soon as
+// the previous one failed, and returns the first established connection.
+func (d *DirectDialer) race(ctx context.Context, network string, targets []string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	delay := d.ConnectionAttemptDelay
+	if delay == 0 {
+		delay = DefaultConnectionAttemptDelay
+	}
+	ch := make(chan result, len(targets))
+	next := 0
+	start := func() {
+		target := targets[next]
+		next++
+		go func() {
+			conn, err := d.dialTarget(ctx, network, target)
+			ch <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var errs []error
+	for running := 1; running > 0 || next < len(targets); {
+		select {
+		case res := <-ch:
+			running--
+			if res.err == nil {
+				// Close the connections that lose the race.
+				go func(running int) {
+					for ; running > 0; running-- {
+						if res := <-ch; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(running)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if next < len(targets) {
+				start()
+				running++
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(targets) {
+				start()
+				running++
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			go func(running int) {
+				for ; running > 0; running-- {
+					if res := <-ch; res.conn != nil {
+						res.conn.Close()
+					}
+				}
+			}(running)
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("all connection attempts failed: %w", errors.Join(errs...))
+}
+
+func filterFamily(addrs []netip.Addr, family string) []netip.Addr {
+	var out []netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if (family == "ip4") == addr.Is4() {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// interleave alternates the families, starting with the preferred one.
+func interleave(firsts, seconds []netip.Addr) []netip.Addr {
+	out := make([]netip.Addr, 0, len(firsts)+len(seconds))
+	for i := 0; i < len(firsts) || i < len(seconds); i++ {
+		if i < len(firsts) {
+			out = append(out, firsts[i])
+		}
+		if i < len(seconds) {
+			out = append(out, seconds[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type staticResolver map[string][]netip.Addr
+
+func (s staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := s[network+"/"+host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestDirectDialerLookup(t *testing.T) {
+	resolver := staticResolver{
+		"ip6/dual.test": {netip.MustParseAddr("::1"), netip.MustParseAddr("::2")},
+		"ip4/dual.test": {netip.MustParseAddr("127.0.0.1")},
+		"ip4/v4.test":   {netip.MustParseAddr("127.0.0.1")},
+	}
+	tests := []struct {
+		preference IPPreference
+		network    string
+		host       string
+		want       []string
+	}{
+		{PreferIPv6, "tcp", "dual.test", []string{"::1", "127.0.0.1", "::2"}},
+		{PreferIPv4, "tcp", "dual.test", []string{"127.0.0.1", "::1", "::2"}},
+		{IPv4Only, "tcp", "dual.test", []string{"127.0.0.1"}},
+		{IPv6Only, "tcp", "dual.test", []string{"::1", "::2"}},
+		{PreferIPv6, "tcp4", "dual.test", []string{"127.0.0.1"}},
+		{PreferIPv6, "tcp", "v4.test", []string{"127.0.0.1"}},
+		{PreferIPv6, "tcp", "static.test", []string{"127.0.0.3"}},
+	}
+	for _, tt := range tests {
+		d := &DirectDialer{
+			Resolver:     resolver,
+			IPPreference: tt.preference,
+			Hosts:        map[string][]netip.Addr{"static.test": {netip.MustParseAddr("127.0.0.3")}},
+		}
+		addrs, err := d.lookup(context.Background(), tt.network, tt.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v %s %s: got %v, want %v", tt.preference, tt.network, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestDirectDialerHosts(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	proxy := httptest.NewServer(&ProxyHandler{
+		DirectDialer: &DirectDialer{
+			Hosts: map[string][]netip.Addr{
+				// Nothing listens on the first address, the second attempt wins.
+				"target.test": {netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")},
+			},
+		},
+	})
+	defer proxy.Close()
+	purl, _ := url.Parse(proxy.URL)
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]*http.Client{
+		"connect": {Transport: &http.Transport{DialContext: dialer.DialContext}},
+		"proxy":   {Transport: &http.Transport{Proxy: http.ProxyURL(purl)}},
+	}
+	for name, cli := range clients {
+		t.Run(name, func(t *testing.T) {
+			resp, err := cli.Get("http://target.test:" + port + "/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if !strings.HasSuffix(strings.TrimSpace(string(body)), "/"+name) {
+				t.Fatal(string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TTLResolver is a Resolver that also reports how long the answer may be cached.
+type TTLResolver interface {
+	Resolver
+	LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error)
+}
+
+// DNSResolver queries a DNS server directly over UDP, falling back to TCP for
+// truncated answers, and reports the TTL of the answers.
+type DNSResolver struct {
+	// Address is the host:port of the DNS server
+	Address string
+	// Dial specifies the optional dial function for reaching the server
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Timeout is the maximum amount of time a query will wait, 5 seconds if zero
+	Timeout time.Duration
+}
+
+// LookupNetIP looks up host, network is one of "ip", "ip4" or "ip6".
+func (r *DNSResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+// LookupNetIPTTL looks up host and returns the smallest TTL of the answers.
+func (r *DNSResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return lookupDNS(ctx, r.exchange, network, host)
+}
+
+// exchange sends a query and returns the answer.
+func (r *DNSResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	answer, err := r.exchangeOn(ctx, "udp", query)
+	if err != nil {
+		return nil, err
+	}
+	var header dnsmessage.Header
+	var p dnsmessage.Parser
+	header, err = p.Start(answer)
+	if err == nil && header.Truncated {
+		return r.exchangeOn(ctx, "tcp", query)
+	}
+	return answer, nil
+}
+
+func (r *DNSResolver) exchangeOn(ctx context.Context, network string, query []byte) ([]byte, error) {
+	dial := r.Dial
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	conn, err := dial(ctx, network, r.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		_, err = conn.Write(append(msg, query...))
+		if err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return nil, err
+		}
+		answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(conn, answer)
+		if err != nil {
+			return nil, err
+		}
+		return answer, nil
+	}
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore answers to other queries.
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// lookupDNS resolves host with queries sent through exchange.
+func lookupDNS(ctx context.Context, exchange func(context.Context, []byte) ([]byte, error), network, host string) ([]netip.Addr, time.Duration, error) {
+	var types []dnsmessage.Type
+	switch network {
+	case "ip":
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	case "ip4":
+		types = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, 0, net.UnknownNetworkError(network)
+	}
+
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	ch := make(chan result, len(types))
+	for _, typ := range types {
+		go func() {
+			query, err := newDNSQuery(host, typ)
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			answer, err := exchange(ctx, query)
+			if err != nil {
+				ch <- result{err: &net.DNSError{Err: err.Error(), Name: host, IsTimeout: errors.Is(err, context.DeadlineExceeded)}}
+				return
+			}
+			addrs, ttl, err := parseDNSAnswer(answer, query, host)
+			ch <- result{addrs, ttl, err}
+		}()
+	}
+
+	var (
+		addrs []netip.Addr
+		ttl   time.Duration = -1
+		errs  []error
+	)
+	for range types {
+		res := <-ch
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		addrs = append(addrs, res.addrs...)
+		if ttl < 0 || res.ttl < ttl {
+			ttl = res.ttl
+		}
+	}
+	if len(addrs) == 0 {
+		if len(errs) != 0 {
+			return nil, 0, errs[0]
+		}
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+// newDNSQuery builds a recursive query for host.
+func newDNSQuery(host string, typ dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	var id [2]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+	err = b.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	err = b.Question(dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseDNSAnswer returns the addresses of an answer and the smallest TTL of its records.
+func parseDNSAnswer(answer, query []byte, host string) ([]netip.Addr, time.Duration, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(answer)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	if len(query) >= 2 && header.ID != binary.BigEndian.Uint16(query) {
+		return nil, 0, &net.DNSError{Err: "mismatched answer id", Name: host}
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("server answered %v", header.RCode), Name: host, IsTemporary: true}
+	}
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	var (
+		addrs []netip.Addr
+		ttl   time.Duration = -1
+	)
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+		}
+		if d := time.Duration(h.TTL) * time.Second; ttl < 0 || d < ttl {
+			ttl = d
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		default:
+			err = p.SkipAnswer()
+			if err != nil {
+				return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
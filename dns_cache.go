@@ -0,0 +1,288 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCacheMinTTL is the default lower bound of the TTL of cached answers.
+	DefaultCacheMinTTL = 5 * time.Second
+	// DefaultCacheMaxTTL is the default upper bound of the TTL of cached answers.
+	DefaultCacheMaxTTL = time.Hour
+	// DefaultCacheTTL is the default TTL of answers of resolvers that do not report it.
+	DefaultCacheTTL = time.Minute
+	// DefaultCacheNegativeTTL is the default TTL of cached lookups of unknown hosts.
+	DefaultCacheNegativeTTL = 10 * time.Second
+	// DefaultCacheMaxEntries is the default maximum number of cached answers.
+	DefaultCacheMaxEntries = 10000
+
+	// cacheLookupTimeout bounds lookups that are shared between callers.
+	cacheLookupTimeout = 10 * time.Second
+)
+
+// DefaultResolver is shared by the DirectDialers without a Resolver,
+// it caches the answers of net.DefaultResolver.
+var DefaultResolver = &CachingResolver{}
+
+// CachingResolver caches the answers of a Resolver. The TTL reported by a
+// TTLResolver is honored, concurrent lookups of a host are coalesced and
+// hot entries are refreshed before they expire.
+type CachingResolver struct {
+	// Resolver answers the lookups that miss the cache, net.DefaultResolver if nil
+	Resolver Resolver
+	// MinTTL is the lower bound of the TTL, DefaultCacheMinTTL if zero
+	MinTTL time.Duration
+	// MaxTTL is the upper bound of the TTL, DefaultCacheMaxTTL if zero
+	MaxTTL time.Duration
+	// NegativeTTL is the TTL of lookups of unknown hosts, DefaultCacheNegativeTTL if zero, disabled if negative
+	NegativeTTL time.Duration
+	// MaxEntries is the maximum number of cached answers, DefaultCacheMaxEntries if zero
+	MaxEntries int
+	// PrefetchHits is the number of hits that make an entry hot, prefetching is disabled if zero
+	PrefetchHits int
+
+	// clock returns the current time, time.Now if nil
+	clock func() time.Time
+
+	mut      sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheCall
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	negatives   atomic.Uint64
+	coalesced   atomic.Uint64
+	prefetches  atomic.Uint64
+	evictions   atomic.Uint64
+	lookupFails atomic.Uint64
+}
+
+type cacheEntry struct {
+	addrs       []netip.Addr
+	err         error
+	ttl         time.Duration
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+type cacheCall struct {
+	done  chan struct{}
+	addrs []netip.Addr
+	ttl   time.Duration
+	err   error
+}
+
+// CacheStats are the counters of a CachingResolver.
+type CacheStats struct {
+	Entries    int
+	Hits       uint64
+	Misses     uint64
+	Negatives  uint64
+	Coalesced  uint64
+	Prefetches uint64
+	Evictions  uint64
+	Failures   uint64
+}
+
+// Stats returns the counters of the cache.
+func (c *CachingResolver) Stats() CacheStats {
+	c.mut.Lock()
+	entries := len(c.entries)
+	c.mut.Unlock()
+	return CacheStats{
+		Entries:    entries,
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Negatives:  c.negatives.Load(),
+		Coalesced:  c.coalesced.Load(),
+		Prefetches: c.prefetches.Load(),
+		Evictions:  c.evictions.Load(),
+		Failures:   c.lookupFails.Load(),
+	}
+}
+
+// Flush drops every cached answer.
+func (c *CachingResolver) Flush() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.entries = nil
+}
+
+// LookupNetIP looks up host, answering from the cache when possible.
+func (c *CachingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := c.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+// LookupNetIPTTL looks up host and returns the remaining TTL of the answer.
+func (c *CachingResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	key := network + "/" + strings.ToLower(strings.TrimSuffix(host, "."))
+	now := c.now()
+
+	c.mut.Lock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		e.hits++
+		remaining := e.expires.Sub(now)
+		if c.PrefetchHits > 0 && e.err == nil && !e.prefetching &&
+			e.hits >= c.PrefetchHits && remaining < e.ttl/10 {
+			e.prefetching = true
+			c.prefetches.Add(1)
+			c.lookup(key, network, host)
+		}
+		c.mut.Unlock()
+		if e.err != nil {
+			c.negatives.Add(1)
+			return nil, 0, e.err
+		}
+		c.hits.Add(1)
+		return e.addrs, remaining, nil
+	}
+	call, ok := c.inflight[key]
+	if ok {
+		c.coalesced.Add(1)
+	} else {
+		c.misses.Add(1)
+		call = c.lookup(key, network, host)
+	}
+	c.mut.Unlock()
+
+	select {
+	case <-call.done:
+		return call.addrs, call.ttl, call.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// lookup starts a lookup shared by every caller of key, c.mut must be held.
+func (c *CachingResolver) lookup(key, network, host string) *cacheCall {
+	call := &cacheCall{done: make(chan struct{})}
+	if c.inflight == nil {
+		c.inflight = map[string]*cacheCall{}
+	}
+	c.inflight[key] = call
+	go c.resolve(key, network, host, call)
+	return call
+}
+
+func (c *CachingResolver) resolve(key, network, host string, call *cacheCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheLookupTimeout)
+	defer cancel()
+
+	var (
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	)
+	switch r := c.resolver().(type) {
+	case TTLResolver:
+		addrs, ttl, err = r.LookupNetIPTTL(ctx, network, host)
+	default:
+		addrs, err = r.LookupNetIP(ctx, network, host)
+		ttl = DefaultCacheTTL
+	}
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var entry *cacheEntry
+	switch {
+	case err == nil:
+		ttl = c.clamp(ttl)
+		entry = &cacheEntry{addrs: addrs, ttl: ttl}
+	case isNotFound(err) && c.negativeTTL() > 0:
+		ttl = c.negativeTTL()
+		entry = &cacheEntry{err: err, ttl: ttl}
+	default:
+		c.lookupFails.Add(1)
+	}
+
+	c.mut.Lock()
+	if entry != nil {
+		entry.expires = c.now().Add(ttl)
+		c.store(key, entry)
+	} else if e, ok := c.entries[key]; ok {
+		// A failed prefetch keeps the entry until it expires.
+		e.prefetching = false
+	}
+	delete(c.inflight, key)
+	c.mut.Unlock()
+
+	call.addrs, call.ttl, call.err = addrs, ttl, err
+	close(call.done)
+}
+
+// store adds the entry, evicting expired ones or else any one when full.
+// c.mut must be held.
+func (c *CachingResolver) store(key string, entry *cacheEntry) {
+	if c.entries == nil {
+		c.entries = map[string]*cacheEntry{}
+	}
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxEntries {
+		now := c.now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+				c.evictions.Add(1)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxEntries {
+				break
+			}
+			delete(c.entries, k)
+			c.evictions.Add(1)
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *CachingResolver) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+func (c *CachingResolver) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (c *CachingResolver) clamp(ttl time.Duration) time.Duration {
+	minTTL := c.MinTTL
+	if minTTL == 0 {
+		minTTL = DefaultCacheMinTTL
+	}
+	maxTTL := c.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = DefaultCacheMaxTTL
+	}
+	return min(max(ttl, minTTL), maxTTL)
+}
+
+func (c *CachingResolver) negativeTTL() time.Duration {
+	if c.NegativeTTL == 0 {
+		return DefaultCacheNegativeTTL
+	}
+	return c.NegativeTTL
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
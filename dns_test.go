@@ -0,0 +1,285 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSHandler answers A queries from records, NXDOMAIN for unknown names.
+type testDNSHandler struct {
+	records map[string]netip.Addr
+	ttl     uint32
+	delay   time.Duration
+	queries atomic.Int32
+}
+
+func (h *testDNSHandler) answer(query []byte) []byte {
+	h.queries.Add(1)
+	time.Sleep(h.delay)
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	header.Response = true
+	addr, ok := h.records[q.Name.String()]
+	if !ok {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, header)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if ok && q.Type == dnsmessage.TypeA {
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: h.ttl}, dnsmessage.AResource{A: addr.As4()})
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+func (h *testDNSHandler) serveUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+			go conn.WriteTo(h.answer(query), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNSResolver(t *testing.T) {
+	h := &testDNSHandler{
+		records: map[string]netip.Addr{"a.test.": netip.MustParseAddr("192.0.2.1")},
+		ttl:     300,
+	}
+	r := &DNSResolver{Address: h.serveUDP(t)}
+
+	addrs, ttl, err := r.LookupNetIPTTL(context.Background(), "ip4", "a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1") || ttl != 300*time.Second {
+		t.Fatal(addrs, ttl)
+	}
+	_, err = r.LookupNetIP(context.Background(), "ip", "missing.test")
+	if !isNotFound(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	h := &testDNSHandler{
+		records: map[string]netip.Addr{"a.test.": netip.MustParseAddr("192.0.2.1")},
+		ttl:     300,
+		delay:   50 * time.Millisecond,
+	}
+	c := &CachingResolver{
+		Resolver: &DNSResolver{Address: h.serveUDP(t)},
+		MaxTTL:   time.Minute,
+	}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i != 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.LookupNetIP(ctx, "ip4", "a.test")
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	_, ttl, err := c.LookupNetIPTTL(ctx, "ip4", "A.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl > time.Minute {
+		t.Fatal("TTL not clamped", ttl)
+	}
+	if q := h.queries.Load(); q != 1 {
+		t.Fatal("queries", q)
+	}
+
+	for i := 0; i != 2; i++ {
+		_, err = c.LookupNetIP(ctx, "ip4", "missing.test")
+		if !isNotFound(err) {
+			t.Fatal(err)
+		}
+	}
+	if q := h.queries.Load(); q != 2 {
+		t.Fatal("unknown host not cached, queries", q)
+	}
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Misses != 2 || stats.Hits != 1 || stats.Negatives != 1 || stats.Coalesced == 0 {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestCachingResolverPrefetch(t *testing.T) {
+	h := &testDNSHandler{
+		records: map[string]netip.Addr{"a.test.": netip.MustParseAddr("192.0.2.1")},
+		ttl:     60,
+	}
+	var mut sync.Mutex
+	now := time.Now()
+	advance := func(d time.Duration) {
+		mut.Lock()
+		defer mut.Unlock()
+		now = now.Add(d)
+	}
+	c := &CachingResolver{
+		Resolver:     &DNSResolver{Address: h.serveUDP(t)},
+		PrefetchHits: 1,
+		clock: func() time.Time {
+			mut.Lock()
+			defer mut.Unlock()
+			return now
+		},
+	}
+	ctx := context.Background()
+
+	_, err := c.LookupNetIP(ctx, "ip4", "a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A hit within the last tenth of the TTL refreshes the entry.
+	advance(55 * time.Second)
+	_, err = c.LookupNetIP(ctx, "ip4", "a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mut.Lock()
+		pending := len(c.inflight)
+		c.mut.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("prefetch not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The original answer expired, the prefetched one is served.
+	advance(10 * time.Second)
+	_, err = c.LookupNetIP(ctx, "ip4", "a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, stats := h.queries.Load(), c.Stats(); q != 2 || stats.Prefetches != 1 || stats.Misses != 1 || stats.Hits != 2 {
+		t.Fatalf("queries %d, %+v", q, stats)
+	}
+}
+
+func TestDefaultResolver(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	before := DefaultResolver.Stats()
+	conn, err := (&ProxyHandler{}).proxyDial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	after := DefaultResolver.Stats()
+	if after.Hits+after.Misses+after.Coalesced == before.Hits+before.Misses+before.Coalesced {
+		t.Fatal("default dials do not use DefaultResolver")
+	}
+}
+
+// serveDoH serves h as a DoH endpoint.
+func (h *testDNSHandler) serveDoH(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != DNSMessageContentType {
+				http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = io.ReadAll(r.Body)
+		}
+		if err != nil || len(query) < 2 || query[0] != 0 || query[1] != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", DNSMessageContentType)
+		w.Write(h.answer(query))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDoHResolver(t *testing.T) {
+	h := &testDNSHandler{
+		records: map[string]netip.Addr{"a.test.": netip.MustParseAddr("192.0.2.1")},
+		ttl:     60,
+	}
+	srv := h.serveDoH(t)
+	proxy := httptest.NewServer(&ProxyHandler{})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolvers := map[string]*DoHResolver{
+		"GET":   {URL: srv.URL},
+		"POST":  {URL: srv.URL, Method: http.MethodPost},
+		"proxy": {URL: srv.URL, ProxyDial: dialer.DialContext},
+	}
+	for name, r := range resolvers {
+		t.Run(name, func(t *testing.T) {
+			addrs, ttl, err := r.LookupNetIPTTL(context.Background(), "ip", "a.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1") || ttl != time.Minute {
+				t.Fatal(addrs, ttl)
+			}
+			_, err = r.LookupNetIP(context.Background(), "ip4", "missing.test")
+			if !isNotFound(err) {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	direct := &DirectDialer{Resolver: &DoHResolver{URL: srv.URL}}
+	_, err = direct.DialContext(context.Background(), "tcp", "missing.test:80")
+	if !isNotFound(err) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,110 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DNSMessageContentType is the media type of DNS messages in DNS-over-HTTPS.
+const DNSMessageContentType = "application/dns-message"
+
+// DoHResolver resolves hosts with DNS-over-HTTPS (RFC 8484) and reports the
+// TTL of the answers.
+type DoHResolver struct {
+	// URL is the URL of the DoH endpoint, e.g. https://dns.example/dns-query
+	URL string
+	// Method is the HTTP method of the queries, http.MethodGet or http.MethodPost, http.MethodGet if empty
+	Method string
+	// Client sends the queries, a client dialing with ProxyDial if nil
+	Client *http.Client
+	// ProxyDial specifies the optional dial function for reaching the endpoint,
+	// e.g. the DialContext of a Dialer
+	ProxyDial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Timeout is the maximum amount of time a query will wait, 5 seconds if zero
+	Timeout time.Duration
+
+	once   sync.Once
+	client *http.Client
+}
+
+// LookupNetIP looks up host, network is one of "ip", "ip4" or "ip6".
+func (r *DoHResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+// LookupNetIPTTL looks up host and returns the smallest TTL of the answers.
+func (r *DoHResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return lookupDNS(ctx, r.exchange, network, host)
+}
+
+func (r *DoHResolver) httpClient() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	r.once.Do(func() {
+		transport := &http.Transport{
+			DialContext:       r.ProxyDial,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}
+		r.client = &http.Client{Transport: transport}
+	})
+	return r.client
+}
+
+// exchange sends a query to the endpoint and returns the answer.
+func (r *DoHResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// The ID should be zero to make the answers cache friendly,
+	// the transport already matches answers to queries.
+	query[0], query[1] = 0, 0
+
+	var req *http.Request
+	var err error
+	switch r.Method {
+	case "", http.MethodGet:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		q := req.URL.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		req.URL.RawQuery = q.Encode()
+	case http.MethodPost:
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", DNSMessageContentType)
+	default:
+		return nil, fmt.Errorf("unsupported DoH method %q", r.Method)
+	}
+	req.Header.Set("Accept", DNSMessageContentType)
+
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server answered %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != DNSMessageContentType {
+		return nil, fmt.Errorf("DoH server answered content type %q", ct)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
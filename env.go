@@ -0,0 +1,86 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+
+	envproxy "golang.org/x/net/http/httpproxy"
+)
+
+// NewEnvDialer is create a dialer from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables (or the lowercase versions thereof).
+func NewEnvDialer() *EnvDialer {
+	return NewEnvDialerFromConfig(envproxy.FromEnvironment())
+}
+
+// NewEnvDialerFromConfig is create a dialer from a proxy configuration,
+// which has the semantics of golang.org/x/net/http/httpproxy.
+func NewEnvDialerFromConfig(config *envproxy.Config) *EnvDialer {
+	return &EnvDialer{
+		proxyFunc: config.ProxyFunc(),
+		dialers:   map[string]*Dialer{},
+	}
+}
+
+// EnvDialer dials directly or through a Dialer depending on the address.
+// Port 80 is dialed through HTTP_PROXY, every other port through HTTPS_PROXY.
+type EnvDialer struct {
+	// ProxyDial specifies the optional dial function for
+	// establishing the direct connection.
+	ProxyDial func(context.Context, string, string) (net.Conn, error)
+
+	proxyFunc func(*url.URL) (*url.URL, error)
+
+	mut     sync.Mutex
+	dialers map[string]*Dialer
+}
+
+// Proxy returns the dialer for the address, nil for dialing directly.
+func (e *EnvDialer) Proxy(address string) (*Dialer, error) {
+	scheme := "https"
+	if _, port, err := net.SplitHostPort(address); err == nil && port == "80" {
+		scheme = "http"
+	}
+	proxy, err := e.proxyFunc(&url.URL{Scheme: scheme, Host: address})
+	if err != nil || proxy == nil {
+		return nil, err
+	}
+
+	key := proxy.String()
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if d, ok := e.dialers[key]; ok {
+		return d, nil
+	}
+	d, err := NewDialer(key)
+	if err != nil {
+		return nil, err
+	}
+	d.ProxyDial = e.ProxyDial
+	e.dialers[key] = d
+	return d, nil
+}
+
+// DialContext connects to the provided address on the provided network.
+func (e *EnvDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, err := e.Proxy(address)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		return d.DialContext(ctx, network, address)
+	}
+	proxyDial := e.ProxyDial
+	if proxyDial == nil {
+		var dialer net.Dialer
+		proxyDial = dialer.DialContext
+	}
+	return proxyDial(ctx, network, address)
+}
+
+// Dial connects to the provided address on the provided network.
+func (e *EnvDialer) Dial(network string, address string) (net.Conn, error) {
+	return e.DialContext(context.Background(), network, address)
+}
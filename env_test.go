@@ -0,0 +1,87 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	envproxy "golang.org/x/net/http/httpproxy"
+)
+
+func TestEnvDialer(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer target.Close()
+	targetAddr := target.Listener.Addr().String()
+
+	var dialer net.Dialer
+	toTarget := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, targetAddr)
+	}
+
+	var proxied atomic.Int32
+	handler := &ProxyHandler{ProxyDial: toTarget}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	var direct atomic.Int32
+	env := NewEnvDialerFromConfig(&envproxy.Config{
+		HTTPProxy:  proxy.URL,
+		HTTPSProxy: proxy.URL,
+		NoProxy:    "direct.test,10.0.0.0/8,.internal.test:8443",
+	})
+	env.ProxyDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address != proxy.Listener.Addr().String() {
+			direct.Add(1)
+			return toTarget(ctx, network, address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	tests := []struct {
+		address string
+		proxied bool
+	}{
+		{"proxied.test:443", true},
+		{"proxied.test:80", true},
+		{"direct.test:443", false},
+		{"10.1.2.3:22", false},
+		{"a.internal.test:8443", false},
+		{"a.internal.test:443", true},
+	}
+	for _, tt := range tests {
+		proxied.Store(0)
+		direct.Store(0)
+		conn, err := env.Dial("tcp", tt.address)
+		if err != nil {
+			t.Fatal(tt.address, err)
+		}
+		conn.Close()
+		if got := proxied.Load() == 1 && direct.Load() == 0; got != tt.proxied {
+			t.Errorf("%s: proxied %d, direct %d", tt.address, proxied.Load(), direct.Load())
+		}
+	}
+}
+
+func TestNewEnvDialer(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://proxy.test:3128")
+	t.Setenv("NO_PROXY", "direct.test")
+
+	env := NewEnvDialer()
+	d, err := env.Proxy("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Proxy != "proxy.test:3128" {
+		t.Fatal(d)
+	}
+	d, err = env.Proxy("direct.test:443")
+	if err != nil || d != nil {
+		t.Fatal(d, err)
+	}
+}
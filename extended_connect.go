@@ -0,0 +1,275 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProtocolPseudoHeader is the key under which the HTTP/2 server exposes the
+	// :protocol pseudo-header of an extended CONNECT request (RFC 8441).
+	ProtocolPseudoHeader = ":protocol"
+
+	// webSocketGUID is the magic value used to compute Sec-WebSocket-Accept.
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// isExtendedConnect reports whether r is an HTTP/2 extended CONNECT request.
+// The HTTP/2 server only advertises SETTINGS_ENABLE_CONNECT_PROTOCOL when
+// GODEBUG contains http2xconnect=1.
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.Header.Get(ProtocolPseudoHeader) != ""
+}
+
+// proxyExtendedConnect handles an HTTP/2 extended CONNECT request.
+func (p *ProxyHandler) proxyExtendedConnect(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Header.Get(ProtocolPseudoHeader)
+	switch strings.ToLower(protocol) {
+	case "websocket":
+		p.proxyWebSocket(w, r)
+	case connectUDPProtocol:
+		p.proxyConnectUDP(w, r)
+	default:
+		e := fmt.Sprintf("unsupported protocol %q", protocol)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusNotImplemented)
+	}
+}
+
+// originAddress returns the hostname and the address to dial of host,
+// the port defaults to the one of scheme.
+func originAddress(scheme, host string) (string, string) {
+	u := url.URL{Host: host}
+	hostname, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	return hostname, net.JoinHostPort(hostname, port)
+}
+
+// proxyWebSocket relays a WebSocket bootstrapped over HTTP/2 (RFC 8441)
+// to the origin as an HTTP/1.1 Upgrade (RFC 6455).
+func (p *ProxyHandler) proxyWebSocket(w http.ResponseWriter, r *http.Request) {
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	hostname, address := originAddress(scheme, r.Host)
+
+	targetConn, err := p.proxyDial(r.Context(), "tcp", address)
+	if err != nil {
+		p.recordRequest(r.Context(), address, 0, 0, err)
+		if p.circuitOpen(w, err) {
+			return
+		}
+		e := fmt.Sprintf("dial %q failed: %v", address, err)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	if scheme == "https" {
+		conn := tls.Client(targetConn, &tls.Config{
+			ServerName: hostname,
+			NextProtos: []string{"http/1.1"},
+		})
+		handshake := spanFromContext(r.Context()).startChild("tls")
+		err = conn.HandshakeContext(r.Context())
+		handshake.end(err)
+		if err != nil {
+			p.recordRequest(r.Context(), address, 0, 0, err)
+			e := fmt.Sprintf("tls handshake %q failed: %v", address, err)
+			if p.Logger != nil {
+				p.Logger.Error(e)
+			}
+			http.Error(w, e, http.StatusBadGateway)
+			return
+		}
+		targetConn = conn
+	}
+
+	key, err := newWebSocketKey()
+	if err != nil {
+		e := err.Error()
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	hdr := r.Header.Clone()
+	hdr.Del(ProtocolPseudoHeader)
+	hdr.Del(ProxyAuthorizationKey)
+	hdr.Set("Connection", "Upgrade")
+	hdr.Set("Upgrade", "websocket")
+	hdr.Set("Sec-WebSocket-Key", key)
+	if hdr.Get("Sec-WebSocket-Version") == "" {
+		hdr.Set("Sec-WebSocket-Version", "13")
+	}
+	if span := spanFromContext(r.Context()); span != nil {
+		hdr.Set(TraceparentKey, span.Traceparent())
+	}
+	upgradeReq := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Host:       r.Host,
+		Header:     hdr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	err = upgradeReq.Write(targetConn)
+	if err != nil {
+		p.recordRequest(r.Context(), address, 0, 0, err)
+		e := fmt.Sprintf("write upgrade request failed: %v", err)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusBadGateway)
+		return
+	}
+
+	br := bufio.NewReader(targetConn)
+	resp, err := http.ReadResponse(br, upgradeReq)
+	if err != nil {
+		p.recordRequest(r.Context(), address, 0, 0, err)
+		e := fmt.Sprintf("read upgrade response failed: %v", err)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusBadGateway)
+		return
+	}
+
+	header := w.Header()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			header[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(w, resp.Body)
+		if err != nil && p.Logger != nil {
+			p.Logger.Warn("copy upgrade response failed", "address", address, "err", err)
+		}
+		return
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		e := "invalid Sec-WebSocket-Accept from origin"
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusBadGateway)
+		return
+	}
+	for k, v := range resp.Header {
+		switch k {
+		case "Connection", "Upgrade", "Sec-Websocket-Accept":
+			continue
+		}
+		header[k] = v
+	}
+	w.WriteHeader(http.StatusOK)
+
+	clientConn, err := newStreamConn(w, r)
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Error("open stream failed", "err", err)
+		}
+		return
+	}
+
+	if p.Observer != nil {
+		p.Observer.TunnelEstablished(r, address)
+	}
+	start := time.Now()
+	result := p.tunnel(r.Context(), &bufConn{targetConn, br}, clientConn)
+	p.tunnelDone(r, address, start, result)
+}
+
+// newWebSocketKey returns a random Sec-WebSocket-Key.
+func newWebSocketKey() (string, error) {
+	var b [16]byte
+	_, err := io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+// webSocketAccept computes the Sec-WebSocket-Accept for the given key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newStreamConn turns the body of a request and its response into a
+// bidirectional stream, as used by CONNECT over HTTP/2.
+func newStreamConn(w http.ResponseWriter, r *http.Request) (io.ReadWriteCloser, error) {
+	rc := http.NewResponseController(w)
+	err := rc.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("flush failed: %w", err)
+	}
+	return &streamConn{
+		ReadCloser: r.Body,
+		w:          w,
+		rc:         rc,
+	}, nil
+}
+
+// streamConn wraps an HTTP/2 stream, flushing every write.
+type streamConn struct {
+	io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	mut    sync.Mutex
+	closed bool
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	// The ResponseWriter must not be used after the handler returns.
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+func (c *streamConn) Close() error {
+	// Unblock a Write waiting for flow control before taking the lock.
+	_ = c.rc.SetWriteDeadline(aLongTimeAgo)
+	c.mut.Lock()
+	c.closed = true
+	c.mut.Unlock()
+	return c.ReadCloser.Close()
+}
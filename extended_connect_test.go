@@ -0,0 +1,375 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func webSocketEchoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	rw.Flush()
+	io.Copy(conn, rw)
+}
+
+type streamResponseWriter struct {
+	header http.Header
+	code   chan int
+	w      io.Writer
+}
+
+func (s *streamResponseWriter) Header() http.Header {
+	return s.header
+}
+
+func (s *streamResponseWriter) WriteHeader(code int) {
+	s.code <- code
+}
+
+func (s *streamResponseWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *streamResponseWriter) Flush() {}
+
+func TestExtendedConnectWebSocket(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(webSocketEchoHandler))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+
+	reqBody, reqWriter := io.Pipe()
+	respBody, respWriter := io.Pipe()
+	w := &streamResponseWriter{
+		header: http.Header{},
+		code:   make(chan int, 1),
+		w:      respWriter,
+	}
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Path: "/chat"},
+		Host:       u.Host,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header: http.Header{
+			ProtocolPseudoHeader:    []string{"websocket"},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+		Body: reqBody,
+	}
+	r = r.WithContext(t.Context())
+
+	go (&ProxyHandler{}).ServeHTTP(w, r)
+
+	if code := <-w.code; code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if w.header.Get("Sec-WebSocket-Accept") != "" {
+		t.Fatal("hop-by-hop header leaked")
+	}
+
+	go reqWriter.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(respBody).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatal(line)
+	}
+	reqWriter.Close()
+}
+
+func TestExtendedConnectUnsupported(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodConnect, "/", nil)
+	r.ProtoMajor = 2
+	r.Header.Set(ProtocolPseudoHeader, "unknown")
+
+	(&ProxyHandler{}).ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Fatal(w.Code)
+	}
+}
+
+// withExtendedConnect reruns the test in a subprocess with extended CONNECT
+// enabled, x/net/http2 reads GODEBUG once at init. It reports whether the
+// caller is that subprocess.
+func withExtendedConnect(t *testing.T) bool {
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, "http2xconnect=1") {
+		return true
+	}
+	if godebug != "" {
+		godebug += ","
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "GODEBUG="+godebug+"http2xconnect=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: "+t.Name()) {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	return false
+}
+
+// h2Stream is an extended CONNECT stream of a minimal HTTP/2 client,
+// http.Transport rejects the :protocol pseudo-header.
+type h2Stream struct {
+	conn   net.Conn
+	mut    sync.Mutex
+	framer *http2.Framer
+	body   *io.PipeReader
+	Status int
+	Header http.Header
+}
+
+// extendedConnect opens an extended CONNECT stream of protocol to the h2c server at addr.
+func extendedConnect(t *testing.T, addr, protocol, authority, path string, header http.Header) *h2Stream {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	err = framer.WriteSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server must allow extended CONNECT in its first SETTINGS.
+	f, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("unexpected frame %v", f)
+	}
+	if v, ok := settings.Value(http2.SettingEnableConnectProtocol); !ok || v != 1 {
+		t.Fatal("extended CONNECT not enabled")
+	}
+	err = framer.WriteSettingsAck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: http.MethodConnect})
+	enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: protocol})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: path})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
+	for k, vv := range header {
+		for _, v := range vv {
+			enc.WriteField(hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+		}
+	}
+	err = framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &h2Stream{conn: conn, framer: framer}
+	for s.Status == 0 {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				s.mut.Lock()
+				framer.WriteSettingsAck()
+				s.mut.Unlock()
+			}
+		case *http2.MetaHeadersFrame:
+			s.Header = http.Header{}
+			for _, field := range f.RegularFields() {
+				s.Header.Add(field.Name, field.Value)
+			}
+			s.Status, _ = strconv.Atoi(f.PseudoValue("status"))
+		case *http2.RSTStreamFrame:
+			t.Fatalf("stream reset: %v", f.ErrCode)
+		}
+	}
+	body, w := io.Pipe()
+	s.body = body
+	go s.readLoop(w)
+	return s
+}
+
+func (s *h2Stream) readLoop(w *io.PipeWriter) {
+	for {
+		f, err := s.framer.ReadFrame()
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		switch f := f.(type) {
+		case *http2.DataFrame:
+			if len(f.Data()) > 0 {
+				w.Write(f.Data())
+				s.mut.Lock()
+				s.framer.WriteWindowUpdate(0, uint32(len(f.Data())))
+				s.framer.WriteWindowUpdate(f.StreamID, uint32(len(f.Data())))
+				s.mut.Unlock()
+			}
+			if f.StreamEnded() {
+				w.Close()
+				return
+			}
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				s.mut.Lock()
+				s.framer.WriteSettingsAck()
+				s.mut.Unlock()
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				s.mut.Lock()
+				s.framer.WritePing(true, f.Data)
+				s.mut.Unlock()
+			}
+		case *http2.RSTStreamFrame:
+			w.CloseWithError(fmt.Errorf("stream reset: %v", f.ErrCode))
+			return
+		case *http2.GoAwayFrame:
+			w.CloseWithError(fmt.Errorf("go away: %v", f.ErrCode))
+			return
+		}
+	}
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	err := s.framer.WriteData(1, false, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite ends the request stream.
+func (s *h2Stream) CloseWrite() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.framer.WriteData(1, true, nil)
+}
+
+func (s *h2Stream) Close() error {
+	return s.conn.Close()
+}
+
+func TestExtendedConnectWebSocketH2(t *testing.T) {
+	if !withExtendedConnect(t) {
+		return
+	}
+	target := httptest.NewServer(http.HandlerFunc(webSocketEchoHandler))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+	proxy := h2cServer(&ProxyHandler{})
+	defer proxy.Server.Close()
+
+	stream := extendedConnect(t, proxy.Listener.Addr().String(), "websocket", u.Host, "/chat", http.Header{
+		"Sec-Websocket-Version": []string{"13"},
+	})
+	if stream.Status != http.StatusOK {
+		t.Fatal(stream.Status)
+	}
+	if stream.Header.Get("Sec-WebSocket-Accept") != "" {
+		t.Fatal("hop-by-hop header leaked")
+	}
+	_, err := io.WriteString(stream, "hello\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatal(line)
+	}
+	stream.CloseWrite()
+}
+
+func TestOriginAddress(t *testing.T) {
+	tests := []struct {
+		scheme, host      string
+		hostname, address string
+	}{
+		{"http", "example.com", "example.com", "example.com:80"},
+		{"https", "example.com", "example.com", "example.com:443"},
+		{"http", "example.com:8080", "example.com", "example.com:8080"},
+		{"https", "[::1]", "::1", "[::1]:443"},
+		{"http", "[::1]:8080", "::1", "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		hostname, address := originAddress(tt.scheme, tt.host)
+		if hostname != tt.hostname || address != tt.address {
+			t.Errorf("originAddress(%q, %q) = %q, %q, want %q, %q", tt.scheme, tt.host, hostname, address, tt.hostname, tt.address)
+		}
+	}
+}
+
+func TestExtendedConnectDialFailure(t *testing.T) {
+	if !withExtendedConnect(t) {
+		return
+	}
+	observer := &recordingObserver{}
+	proxy := h2cServer(&ProxyHandler{Observer: observer})
+	defer proxy.Server.Close()
+
+	dead := strings.TrimPrefix(deadProxyURL(t), "http://")
+	stream := extendedConnect(t, proxy.Listener.Addr().String(), "websocket", dead, "/chat", nil)
+	defer stream.Close()
+	if stream.Status != http.StatusBadGateway {
+		t.Fatal(stream.Status)
+	}
+	for i := 0; len(observer.Events()) < 4 && i != 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := observer.Events()
+	if len(events) != 4 || !strings.HasPrefix(events[3], "request done 502 0 ") || strings.HasSuffix(events[3], "<nil>") {
+		t.Fatalf("dial failure not recorded %q", events)
+	}
+}
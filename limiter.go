@@ -0,0 +1,220 @@
+package httpproxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientLimit limits the requests of a client.
+type ClientLimit struct {
+	// MaxTunnels is the maximum number of concurrent tunnels, unlimited if zero
+	MaxTunnels int
+	// RequestsPerSecond is the sustained rate of requests, unlimited if zero
+	RequestsPerSecond float64
+	// Burst is the number of requests allowed at once, RequestsPerSecond but at least 1 if zero
+	Burst int
+}
+
+func (l ClientLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(math.Ceil(l.RequestsPerSecond), 1)
+}
+
+// RateLimitError is returned when a client exceeds its limits.
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many requests from %s, retry after %v", e.Key, e.RetryAfter)
+}
+
+// Limiter limits the requests and tunnels per source IP and per identity.
+type Limiter struct {
+	// PerIP limits each source IP, it applies before authentication
+	PerIP ClientLimit
+	// PerIdentity limits each authenticated identity
+	PerIdentity ClientLimit
+	// TunnelRetryAfter is the Retry-After of a rejected tunnel, one second if zero
+	TunnelRetryAfter time.Duration
+
+	mut       sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+type clientState struct {
+	tunnels int
+	tokens  float64
+	last    time.Time
+}
+
+// Allow admits a request of the client key under limit, tunnel reports whether
+// the request opens a tunnel. The returned func must be called once the request
+// is done.
+func (l *Limiter) Allow(key string, limit ClientLimit, tunnel bool) (func(), error) {
+	if limit.MaxTunnels <= 0 && limit.RequestsPerSecond <= 0 {
+		return func() {}, nil
+	}
+	now := time.Now()
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.sweep(now)
+	c, ok := l.clients[key]
+	if !ok {
+		if l.clients == nil {
+			l.clients = map[string]*clientState{}
+		}
+		c = &clientState{tokens: limit.burst(), last: now}
+		l.clients[key] = c
+	}
+
+	if tunnel && limit.MaxTunnels > 0 && c.tunnels >= limit.MaxTunnels {
+		retryAfter := l.TunnelRetryAfter
+		if retryAfter == 0 {
+			retryAfter = time.Second
+		}
+		return nil, &RateLimitError{Key: key, RetryAfter: retryAfter}
+	}
+	if limit.RequestsPerSecond > 0 {
+		c.tokens = math.Min(c.tokens+now.Sub(c.last).Seconds()*limit.RequestsPerSecond, limit.burst())
+		c.last = now
+		if c.tokens < 1 {
+			retryAfter := time.Duration((1 - c.tokens) / limit.RequestsPerSecond * float64(time.Second))
+			return nil, &RateLimitError{Key: key, RetryAfter: retryAfter}
+		}
+		c.tokens--
+	}
+	if !tunnel {
+		return func() {}, nil
+	}
+	c.tunnels++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mut.Lock()
+			defer l.mut.Unlock()
+			c.tunnels--
+		})
+	}, nil
+}
+
+// sweep forgets the clients without tunnels whose bucket refilled, l.mut must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, c := range l.clients {
+		if c.tunnels == 0 && now.Sub(c.last) > time.Minute {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// limit applies the limit of key to the request, it responds 429 if the limit is exceeded.
+func (p *ProxyHandler) limit(w http.ResponseWriter, key string, limit ClientLimit, tunnel bool) (func(), bool) {
+	release, err := p.Limiter.Allow(key, limit, tunnel)
+	if err == nil {
+		return release, true
+	}
+	e := err.Error()
+	if p.Logger != nil {
+		p.Logger.Warn(e)
+	}
+	if err, ok := err.(*RateLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	}
+	http.Error(w, e, http.StatusTooManyRequests)
+	return nil, false
+}
+
+// NewLimitListener returns a listener that accepts at most max concurrent
+// connections. Excess connections wait in the backlog of the listener if
+// queue is true, otherwise they are answered with 503 and closed.
+func NewLimitListener(listener net.Listener, max int, queue bool) net.Listener {
+	return &limitListener{
+		Listener: listener,
+		sem:      make(chan struct{}, max),
+		queue:    queue,
+		done:     make(chan struct{}),
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	queue     bool
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.queue {
+		select {
+		case l.sem <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			<-l.sem
+			return nil, err
+		}
+		return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+	}
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+		default:
+			go rejectConn(conn)
+		}
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// rejectConn answers a connection over the limit with 503 and closes it.
+func rejectConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	body := "too many connections\n"
+	fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nRetry-After: 1\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
+
+// limitConn frees its slot of the limitListener when closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) netConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (c *limitConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,132 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLimiterRequestsPerSecond(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	proxy := httptest.NewServer(&ProxyHandler{
+		Limiter: &Limiter{PerIP: ClientLimit{RequestsPerSecond: 1, Burst: 2}},
+	})
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := cli.Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("request %d: %s", i, resp.Status)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "1" {
+			t.Fatal("Retry-After", resp.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestLimiterTunnels(t *testing.T) {
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("alice", "secret"),
+		Limiter:        &Limiter{PerIdentity: ClientLimit{MaxTunnels: 1}},
+	})
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("alice", "secret")
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := countingServer(t)
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dialer.Dial("tcp", target)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || connectErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("second tunnel", err)
+	}
+
+	conn.Close()
+	for i := 0; ; i++ {
+		conn, err = dialer.Dial("tcp", target)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal("tunnel not released", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSimpleServerMaxConns(t *testing.T) {
+	for _, queue := range []bool{false, true} {
+		t.Run(fmt.Sprint("queue=", queue), func(t *testing.T) {
+			s, err := NewSimpleServer("http://127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.MaxConns = 1
+			s.QueueConns = queue
+			err = s.Start(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			first, err := net.Dial("tcp", s.Address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Make sure the first connection is accepted.
+			fmt.Fprint(first, "GET /first HTTP/1.1\r\nHost: x\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(first), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			second, err := net.Dial("tcp", s.Address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+			fmt.Fprint(second, "GET /second HTTP/1.1\r\nHost: x\r\n\r\n")
+			if queue {
+				time.AfterFunc(100*time.Millisecond, func() { first.Close() })
+			} else {
+				defer first.Close()
+			}
+			second.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp, err = http.ReadResponse(bufio.NewReader(second), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			want := http.StatusServiceUnavailable
+			if queue {
+				want = http.StatusNotFound
+			}
+			if resp.StatusCode != want {
+				t.Fatal(resp.Status)
+			}
+		})
+	}
+}
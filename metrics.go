@@ -0,0 +1,310 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the latency histograms.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics is an Observer collecting metrics of a ProxyHandler,
+// it serves them in the Prometheus text exposition format.
+//
+// The bytes of a tunnel are counted once the tunnel is closed.
+type Metrics struct {
+	// Namespace prefixes the names of the metrics, "httpproxy" if empty
+	Namespace string
+	// Buckets are the upper bounds in seconds of the latency histograms, DefaultLatencyBuckets if nil
+	Buckets []float64
+	// CircuitBreaker is the breaker whose circuits are served with the metrics, none if nil
+	CircuitBreaker *CircuitBreaker
+
+	mut            sync.Mutex
+	requests       map[[2]string]uint64
+	durations      map[string]*histogram
+	tunnelsActive  int64
+	tunnelsTotal   uint64
+	dials          map[string]*histogram
+	uploaded       uint64
+	downloaded     uint64
+	authFailures   uint64
+	upstreamErrors map[string]uint64
+}
+
+var _ Observer = (*Metrics)(nil)
+
+func (m *Metrics) Accept(r *http.Request) {}
+
+func (m *Metrics) AuthSuccess(r *http.Request, identity string) {}
+
+func (m *Metrics) AuthFailure(r *http.Request) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.authFailures++
+}
+
+func (m *Metrics) DialStart(ctx context.Context, network, address string) {}
+
+func (m *Metrics) DialDone(ctx context.Context, info DialInfo) {
+	route := routeLabel(info.Route)
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.dials == nil {
+		m.dials = map[string]*histogram{}
+	}
+	h, ok := m.dials[route]
+	if !ok {
+		h = newHistogram(m.buckets())
+		m.dials[route] = h
+	}
+	h.observe(info.Duration.Seconds())
+	// Dials canceled by the client are not the fault of the upstream.
+	if info.Err != nil && !errors.Is(info.Err, context.Canceled) {
+		if m.upstreamErrors == nil {
+			m.upstreamErrors = map[string]uint64{}
+		}
+		m.upstreamErrors[route]++
+	}
+}
+
+func (m *Metrics) TunnelEstablished(r *http.Request, address string) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.tunnelsActive++
+	m.tunnelsTotal++
+}
+
+func (m *Metrics) TunnelClosed(r *http.Request, info TunnelInfo) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.tunnelsActive--
+}
+
+func (m *Metrics) RequestDone(r *http.Request, info RequestInfo) {
+	method := methodLabel(r.Method)
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.requests == nil {
+		m.requests = map[[2]string]uint64{}
+		m.durations = map[string]*histogram{}
+	}
+	m.requests[[2]string{method, strconv.Itoa(info.StatusCode)}]++
+	h, ok := m.durations[method]
+	if !ok {
+		h = newHistogram(m.buckets())
+		m.durations[method] = h
+	}
+	h.observe(info.Duration.Seconds())
+	m.uploaded += uint64(info.Upload)
+	m.downloaded += uint64(info.Download)
+}
+
+func (m *Metrics) buckets() []float64 {
+	if m.Buckets != nil {
+		return m.Buckets
+	}
+	return DefaultLatencyBuckets
+}
+
+// routeLabel names the route of DialInfo.Route, "upstream" for the routes without a name.
+func routeLabel(route string) string {
+	if route == "" {
+		return "upstream"
+	}
+	return route
+}
+
+// methodLabel limits the methods to the known ones, the others are "OTHER".
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	ns := m.Namespace
+	if ns == "" {
+		ns = "httpproxy"
+	}
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{Writer: bw}
+
+	m.mut.Lock()
+	writeHeader(cw, ns+"_requests_total", "counter", "Requests by method and status code.")
+	keys := make([][2]string, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(cw, "%s_requests_total{method=%s,code=%s} %d\n", ns, quoteLabel(key[0]), quoteLabel(key[1]), m.requests[key])
+	}
+
+	writeHeader(cw, ns+"_request_duration_seconds", "histogram", "Duration of requests by method, tunnels last until closed.")
+	writeHistograms(cw, ns+"_request_duration_seconds", "method", m.durations)
+
+	writeHeader(cw, ns+"_tunnels_active", "gauge", "Open tunnels.")
+	fmt.Fprintf(cw, "%s_tunnels_active %d\n", ns, m.tunnelsActive)
+	writeHeader(cw, ns+"_tunnels_total", "counter", "Established tunnels.")
+	fmt.Fprintf(cw, "%s_tunnels_total %d\n", ns, m.tunnelsTotal)
+
+	writeHeader(cw, ns+"_dial_duration_seconds", "histogram", "Duration of dials of destinations and upstreams by route.")
+	writeHistograms(cw, ns+"_dial_duration_seconds", "route", m.dials)
+
+	writeHeader(cw, ns+"_bytes_total", "counter", "Bytes of request bodies and tunnels by direction.")
+	fmt.Fprintf(cw, "%s_bytes_total{direction=\"upload\"} %d\n", ns, m.uploaded)
+	fmt.Fprintf(cw, "%s_bytes_total{direction=\"download\"} %d\n", ns, m.downloaded)
+
+	writeHeader(cw, ns+"_auth_failures_total", "counter", "Requests rejected by the authentication.")
+	fmt.Fprintf(cw, "%s_auth_failures_total %d\n", ns, m.authFailures)
+
+	writeHeader(cw, ns+"_upstream_errors_total", "counter", "Failed dials of destinations and upstreams by route.")
+	routes := sortedKeys(m.upstreamErrors)
+	for _, route := range routes {
+		fmt.Fprintf(cw, "%s_upstream_errors_total{route=%s} %d\n", ns, quoteLabel(route), m.upstreamErrors[route])
+	}
+	m.mut.Unlock()
+
+	if m.CircuitBreaker != nil {
+		writeCircuits(cw, ns, m.CircuitBreaker)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// ServeHTTP serves the metrics, the handler is meant for an admin listener.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// writeCircuits writes the state of each circuit of b, one series per state, and its counters.
+func writeCircuits(w io.Writer, ns string, b *CircuitBreaker) {
+	circuits, opened, rejected := b.Metrics()
+	writeHeader(w, ns+"_circuit_state", "gauge", "State of the circuits by key, 1 for the current state.")
+	for _, c := range circuits {
+		for _, state := range []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+			var value int
+			if c.State == state {
+				value = 1
+			}
+			fmt.Fprintf(w, "%s_circuit_state{key=%s,state=%s} %d\n", ns, quoteLabel(c.Key), quoteLabel(state.String()), value)
+		}
+	}
+	writeHeader(w, ns+"_circuit_failures", "gauge", "Consecutive failures of the circuits by key.")
+	for _, c := range circuits {
+		fmt.Fprintf(w, "%s_circuit_failures{key=%s} %d\n", ns, quoteLabel(c.Key), c.Failures)
+	}
+	writeHeader(w, ns+"_circuit_opened_total", "counter", "Times circuits were opened.")
+	fmt.Fprintf(w, "%s_circuit_opened_total %d\n", ns, opened)
+	writeHeader(w, ns+"_circuit_rejected_total", "counter", "Calls rejected by open circuits.")
+	fmt.Fprintf(w, "%s_circuit_rejected_total %d\n", ns, rejected)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistograms(w io.Writer, name, label string, histograms map[string]*histogram) {
+	for _, value := range sortedKeys(histograms) {
+		h := histograms[value]
+		var count uint64
+		for i, bound := range h.bounds {
+			count += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"%s\"} %d\n", name, label, quoteLabel(value), formatFloat(bound), count)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"+Inf\"} %d\n", name, label, quoteLabel(value), h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%s} %s\n", name, label, quoteLabel(value), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s=%s} %d\n", name, label, quoteLabel(value), h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value of the text exposition format.
+func quoteLabel(value string) string {
+	return `"` + labelReplacer.Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// histogram counts observations per bucket, counts are not cumulative.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+// countingWriter counts the bytes written and keeps the first error.
+type countingWriter struct {
+	io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
@@ -0,0 +1,159 @@
+package httpproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer target.Close()
+	metrics := &Metrics{Buckets: []float64{0.5, 1}}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("alice", "secret"),
+		Observer:       metrics,
+	})
+	defer proxy.Close()
+	admin := httptest.NewServer(metrics)
+	defer admin.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("alice", "wrong")
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	resp, err := cli.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	u.User = url.UserPassword("alice", "secret")
+	cli = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	resp, err = cli.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", countingServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello")
+	closeWrite(conn)
+	io.ReadAll(conn)
+	conn.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	_, err = dialer.Dial("tcp", closed)
+	if err == nil {
+		t.Fatal("dial of a closed port succeeded")
+	}
+
+	want := []string{
+		`httpproxy_requests_total{method="CONNECT",code="200"} 1`,
+		`httpproxy_requests_total{method="CONNECT",code="500"} 1`,
+		`httpproxy_requests_total{method="GET",code="200"} 1`,
+		`httpproxy_requests_total{method="GET",code="407"} 1`,
+		`httpproxy_request_duration_seconds_count{method="GET"} 2`,
+		`httpproxy_tunnels_active 0`,
+		`httpproxy_tunnels_total 1`,
+		`httpproxy_dial_duration_seconds_bucket{route="direct",le="+Inf"} 3`,
+		`httpproxy_dial_duration_seconds_count{route="direct"} 3`,
+		`httpproxy_bytes_total{direction="upload"} 5`,
+		`httpproxy_bytes_total{direction="download"} 11`,
+		`httpproxy_auth_failures_total 1`,
+		`httpproxy_upstream_errors_total{route="direct"} 1`,
+		`# TYPE httpproxy_dial_duration_seconds histogram`,
+	}
+	var body string
+	for i := 0; i != 50; i++ {
+		resp, err = http.Get(admin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = string(b)
+		if strings.Contains(body, `method="CONNECT",code="200"`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsCircuitBreaker(t *testing.T) {
+	breaker := &CircuitBreaker{FailureThreshold: 1}
+	done, err := breaker.Allow("host:example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(OutcomeFailure)
+	_, err = breaker.Allow("host:example.com")
+	if err == nil {
+		t.Fatal("open circuit allowed the call")
+	}
+
+	metrics := &Metrics{CircuitBreaker: breaker}
+	var buf strings.Builder
+	_, err = metrics.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`httpproxy_circuit_state{key="host:example.com",state="closed"} 0`,
+		`httpproxy_circuit_state{key="host:example.com",state="open"} 1`,
+		`httpproxy_circuit_state{key="host:example.com",state="half-open"} 0`,
+		`httpproxy_circuit_failures{key="host:example.com"} 1`,
+		`httpproxy_circuit_opened_total 1`,
+		`httpproxy_circuit_rejected_total 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 2})
+	for _, v := range []float64{0.5, 1, 1.5, 3} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	writeHistograms(&b, "h", "l", map[string]*histogram{"a\"b": h})
+	want := `h_bucket{l="a\"b",le="1"} 2
+h_bucket{l="a\"b",le="2"} 3
+h_bucket{l="a\"b",le="+Inf"} 4
+h_sum{l="a\"b"} 6
+h_count{l="a\"b"} 4
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,333 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Observer is notified about the lifecycle of the requests of a ProxyHandler.
+// The methods are called synchronously from the goroutine serving the request
+// and must not block. Embed NopObserver to implement only some of them.
+type Observer interface {
+	// Accept is called when a request arrives, before authentication.
+	Accept(r *http.Request)
+	// AuthSuccess is called when the credentials of the request are valid.
+	AuthSuccess(r *http.Request, identity string)
+	// AuthFailure is called when the request is rejected by the Authentication.
+	AuthFailure(r *http.Request)
+	// DialStart is called before dialing a destination or an upstream.
+	DialStart(ctx context.Context, network, address string)
+	// DialDone is called once the dial finished.
+	DialDone(ctx context.Context, info DialInfo)
+	// TunnelEstablished is called once a tunnel to address is open.
+	TunnelEstablished(r *http.Request, address string)
+	// TunnelClosed is called once both directions of a tunnel finished.
+	TunnelClosed(r *http.Request, info TunnelInfo)
+	// RequestDone is called once the handler of any request returned,
+	// including tunnels and requests rejected by the proxy.
+	RequestDone(r *http.Request, info RequestInfo)
+}
+
+// DialInfo describes a finished dial.
+type DialInfo struct {
+	Network string
+	Address string
+	// Route is the name of the route, empty for ProxyHandler.Upstream and
+	// for upstreams dialed by the transport of proxied requests
+	Route string
+	// Upstream is the address of the upstream proxy, empty for direct dials
+	Upstream string
+	Duration time.Duration
+	Err      error
+}
+
+// TunnelInfo describes a closed tunnel.
+type TunnelInfo struct {
+	// Address is the destination, the name of a reverse tunnel or empty for a UDP relay
+	Address string
+	// Upload is the bytes from the client to the destination
+	Upload int64
+	// Download is the bytes from the destination to the client
+	Download int64
+	Duration time.Duration
+	Err      error
+}
+
+// RequestInfo describes a finished request.
+type RequestInfo struct {
+	Address string
+	// Route is the name of the route of the last dial, see DialInfo.Route
+	Route string
+	// Upstream is the upstream proxy of the last dial, empty for direct dials
+	Upstream string
+	// StatusCode is the status of the response sent to the client,
+	// 101 for hijacked connections answered without WriteHeader
+	StatusCode int
+	// Upload is the bytes of the request body or sent through the tunnel
+	Upload int64
+	// Download is the bytes of the response body or received through the tunnel
+	Download int64
+	Duration time.Duration
+	// DialDuration is the time spent dialing
+	DialDuration time.Duration
+	Err          error
+}
+
+// NopObserver implements Observer with methods doing nothing.
+type NopObserver struct{}
+
+func (NopObserver) Accept(r *http.Request)                                 {}
+func (NopObserver) AuthSuccess(r *http.Request, identity string)           {}
+func (NopObserver) AuthFailure(r *http.Request)                            {}
+func (NopObserver) DialStart(ctx context.Context, network, address string) {}
+func (NopObserver) DialDone(ctx context.Context, info DialInfo)            {}
+func (NopObserver) TunnelEstablished(r *http.Request, address string)      {}
+func (NopObserver) TunnelClosed(r *http.Request, info TunnelInfo)          {}
+func (NopObserver) RequestDone(r *http.Request, info RequestInfo)          {}
+
+// MultiObserver returns an Observer notifying each of observers in order.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) Accept(r *http.Request) {
+	for _, o := range m {
+		o.Accept(r)
+	}
+}
+
+func (m multiObserver) AuthSuccess(r *http.Request, identity string) {
+	for _, o := range m {
+		o.AuthSuccess(r, identity)
+	}
+}
+
+func (m multiObserver) AuthFailure(r *http.Request) {
+	for _, o := range m {
+		o.AuthFailure(r)
+	}
+}
+
+func (m multiObserver) DialStart(ctx context.Context, network, address string) {
+	for _, o := range m {
+		o.DialStart(ctx, network, address)
+	}
+}
+
+func (m multiObserver) DialDone(ctx context.Context, info DialInfo) {
+	for _, o := range m {
+		o.DialDone(ctx, info)
+	}
+}
+
+func (m multiObserver) TunnelEstablished(r *http.Request, address string) {
+	for _, o := range m {
+		o.TunnelEstablished(r, address)
+	}
+}
+
+func (m multiObserver) TunnelClosed(r *http.Request, info TunnelInfo) {
+	for _, o := range m {
+		o.TunnelClosed(r, info)
+	}
+}
+
+func (m multiObserver) RequestDone(r *http.Request, info RequestInfo) {
+	for _, o := range m {
+		o.RequestDone(r, info)
+	}
+}
+
+// observedDial notifies the Observer and the Tracer about a dial of route through upstream.
+func (p *ProxyHandler) observedDial(ctx context.Context, route, upstream, network, address string, dial func(context.Context) (net.Conn, error)) (net.Conn, error) {
+	if p.Observer == nil && p.Tracer == nil {
+		return dial(ctx)
+	}
+	if p.Observer != nil {
+		p.Observer.DialStart(ctx, network, address)
+	}
+	span := spanFromContext(ctx).startChild("dial",
+		Attribute{"network.transport", network},
+		Attribute{"server.address", address},
+		Attribute{"httpproxy.route", route})
+	if upstream != "" {
+		span.setAttributes(Attribute{"httpproxy.upstream", upstream})
+	}
+	start := time.Now()
+	conn, err := dial(ctx)
+	duration := time.Since(start)
+	span.end(err)
+	if state := requestStateFromContext(ctx); state != nil {
+		state.update(func(info *RequestInfo) {
+			info.Route = route
+			info.Upstream = upstream
+			info.DialDuration += duration
+		})
+	}
+	if p.Observer != nil {
+		p.Observer.DialDone(ctx, DialInfo{
+			Network:  network,
+			Address:  address,
+			Route:    route,
+			Upstream: upstream,
+			Duration: duration,
+			Err:      err,
+		})
+	}
+	return conn, err
+}
+
+// tunnelDone reports a closed tunnel to the Logger, the Accounting, the Observer and the Tracer.
+func (p *ProxyHandler) tunnelDone(r *http.Request, address string, start time.Time, result tunnelResult) {
+	p.account(r, address, result.Upload.Bytes, result.Download.Bytes)
+	p.tunnelClosed(r, address, start, result)
+}
+
+// tunnelClosed is tunnelDone without the Accounting, for tunnels accounted per peer.
+func (p *ProxyHandler) tunnelClosed(r *http.Request, address string, start time.Time, result tunnelResult) {
+	err := result.Err()
+	if err != nil && p.Logger != nil {
+		p.Logger.Warn("tunnel failed", "address", address, "err", err)
+	}
+	p.recordRequest(r.Context(), address, result.Upload.Bytes, result.Download.Bytes, err)
+	transfer := spanFromContext(r.Context()).startChildAt("transfer", start,
+		Attribute{"httpproxy.upload", result.Upload.Bytes},
+		Attribute{"httpproxy.download", result.Download.Bytes})
+	transfer.end(err)
+	if p.Observer != nil {
+		p.Observer.TunnelClosed(r, TunnelInfo{
+			Address:  address,
+			Upload:   result.Upload.Bytes,
+			Download: result.Download.Bytes,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+	}
+}
+
+type requestStateContextKey struct{}
+
+// requestState collects what the handler of a request knows for RequestDone.
+type requestState struct {
+	start time.Time
+	mut   sync.Mutex
+	info  RequestInfo
+}
+
+func requestStateFromContext(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestStateContextKey{}).(*requestState)
+	return state
+}
+
+func (s *requestState) update(f func(info *RequestInfo)) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	f(&s.info)
+}
+
+// recordRequest records the outcome of the request in ctx for RequestDone.
+func (p *ProxyHandler) recordRequest(ctx context.Context, address string, upload, download int64, err error) {
+	if state := requestStateFromContext(ctx); state != nil {
+		state.update(func(info *RequestInfo) {
+			info.Address = address
+			info.Upload = upload
+			info.Download = download
+			info.Err = err
+		})
+	}
+}
+
+// observe prepares a request for RequestDone and its span, the returned func reports it.
+func (p *ProxyHandler) observe(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func(r *http.Request)) {
+	if p.Observer != nil {
+		p.Observer.Accept(r)
+	}
+	state := &requestState{start: time.Now()}
+	sw := &statusWriter{ResponseWriter: w}
+	ctx := context.WithValue(r.Context(), requestStateContextKey{}, state)
+	var span *Span
+	if p.Tracer != nil {
+		ctx, span = p.Tracer.startRequest(ctx, r)
+	}
+	r = r.WithContext(ctx)
+	return sw, r, func(r *http.Request) {
+		state.mut.Lock()
+		info := state.info
+		state.mut.Unlock()
+		if info.Address == "" {
+			info.Address = r.URL.Host
+		}
+		info.StatusCode = sw.status()
+		info.Duration = time.Since(state.start)
+		span.endRequest(r, info)
+		if p.Observer != nil {
+			p.Observer.RequestDone(r, info)
+		}
+	}
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	statusCode int
+	hijacked   bool
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 && statusCode >= http.StatusOK {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	w.FlushError()
+}
+
+func (w *statusWriter) FlushError() error {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// status returns the status code sent to the client.
+func (w *statusWriter) status() int {
+	switch {
+	case w.statusCode != 0:
+		return w.statusCode
+	case w.hijacked:
+		return http.StatusSwitchingProtocols
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,222 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the events it observes.
+type recordingObserver struct {
+	mut    sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) Events() []string {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	return append([]string(nil), o.events...)
+}
+
+func (o *recordingObserver) Accept(r *http.Request) {
+	o.record("accept %s", r.Method)
+}
+
+func (o *recordingObserver) AuthSuccess(r *http.Request, identity string) {
+	o.record("auth success %s", identity)
+}
+
+func (o *recordingObserver) AuthFailure(r *http.Request) {
+	o.record("auth failure")
+}
+
+func (o *recordingObserver) DialStart(ctx context.Context, network, address string) {
+	o.record("dial start %s", network)
+}
+
+func (o *recordingObserver) DialDone(ctx context.Context, info DialInfo) {
+	o.record("dial done %s %s %v", info.Network, info.Route, info.Err)
+}
+
+func (o *recordingObserver) TunnelEstablished(r *http.Request, address string) {
+	o.record("tunnel established")
+}
+
+func (o *recordingObserver) TunnelClosed(r *http.Request, info TunnelInfo) {
+	o.record("tunnel closed %d %d %v", info.Upload, info.Download, info.Err)
+}
+
+func (o *recordingObserver) RequestDone(r *http.Request, info RequestInfo) {
+	o.record("request done %d %d %v", info.StatusCode, info.Download, info.Err)
+}
+
+func TestObserver(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer target.Close()
+	observer := &recordingObserver{}
+	other := &recordingObserver{}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("alice", "secret"),
+		Observer:       MultiObserver(observer, other),
+	})
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+
+	u.User = url.UserPassword("alice", "wrong")
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	resp, err := cli.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	u.User = url.UserPassword("alice", "secret")
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", countingServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello")
+	closeWrite(conn)
+	io.ReadAll(conn)
+	conn.Close()
+
+	want := []string{
+		"accept GET",
+		"auth failure",
+		"request done 407 0 <nil>",
+		"accept CONNECT",
+		"auth success alice",
+		"dial start tcp",
+		"dial done tcp direct <nil>",
+		"tunnel established",
+		"tunnel closed 5 1 <nil>",
+		"request done 200 1 <nil>",
+	}
+	for i := 0; len(observer.Events()) < len(want) && i != 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := observer.Events(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	cli = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	resp, err = cli.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	for i := 0; len(observer.Events()) < len(want)+5 && i != 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want = append(want,
+		"accept GET",
+		"auth success alice",
+		"dial start tcp",
+		"dial done tcp direct <nil>",
+		"request done 200 10 <nil>",
+	)
+	if got := observer.Events(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(observer.Events(), other.Events()) {
+		t.Fatal("MultiObserver did not notify every observer")
+	}
+}
+
+func TestObserverTunnels(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	observer := &recordingObserver{}
+	registry := NewReverseRegistry()
+	registry.Domains = []string{"*.tunnel.test"}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Observer: observer,
+		UDPRelay: true,
+		Reverse:  registry,
+	})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := func(n int) []string {
+		for i := 0; len(observer.Events()) < n && i != 50; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return observer.Events()
+	}
+
+	// CONNECT-UDP and the UDP relay each echo 4 bytes.
+	for i, open := range []func() (net.PacketConn, error){
+		func() (net.PacketConn, error) { return dialer.DialUDP("udp", echo.LocalAddr().String()) },
+		func() (net.PacketConn, error) { return dialer.ListenPacket(context.Background(), "udp", "") },
+	} {
+		c, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.WriteTo([]byte("ping"), echo.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = c.ReadFrom(make([]byte, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		wait(6 * (i + 1))
+	}
+
+	want := []string{
+		"accept GET",
+		"dial start udp",
+		"dial done udp direct <nil>",
+		"tunnel established",
+		"tunnel closed 4 4 <nil>",
+		"request done 101 4 <nil>",
+		"accept GET",
+		"tunnel established",
+		"dial start udp",
+		"dial done udp direct <nil>",
+		"tunnel closed 4 4 <nil>",
+		"request done 101 4 <nil>",
+	}
+	if got := wait(len(want)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	listener, err := dialer.Listen(context.Background(), "tcp", "device.tunnel.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(len(want) + 2)
+	listener.Close()
+	got := wait(len(want) + 4)[len(want):]
+	if len(got) != 4 || got[1] != "tunnel established" ||
+		!strings.HasPrefix(got[2], "tunnel closed") || !strings.HasPrefix(got[3], "request done 101") {
+		t.Fatalf("reverse tunnel events %q", got)
+	}
+}
@@ -0,0 +1,217 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// PACContentType is the MIME type of proxy auto-config files.
+	PACContentType = "application/x-ns-proxy-autoconfig"
+
+	// DefaultPACMaxAge is the default max-age of proxy auto-config files.
+	DefaultPACMaxAge = time.Hour
+)
+
+// isPACPath reports whether path is a well-known proxy auto-config location.
+func isPACPath(path string) bool {
+	return path == "/proxy.pac" || path == "/wpad.dat"
+}
+
+// PAC serves a proxy auto-config file generated from the routing and bypass rules.
+// Whatever the file cannot express exactly is sent to the proxy.
+type PAC struct {
+	// Proxy is the address clients use to reach the proxy, the Host of the request if empty
+	Proxy string
+	// Router provides the rules, that of the ProxyHandler if nil
+	Router *Router
+	// BypassDirectRoutes lets clients connect directly to the destinations routed Direct
+	BypassDirectRoutes bool
+	// Bypass are host patterns clients connect to directly, in the syntax of Rule.Hosts
+	Bypass []string
+	// Template overrides the generated file, it is executed with PACData
+	Template *template.Template
+	// MaxAge is the max-age of Cache-Control, DefaultPACMaxAge if zero
+	MaxAge time.Duration
+}
+
+// PACData is the data of a PAC template.
+type PACData struct {
+	// Proxy is the PAC result for the proxy, like "PROXY 127.0.0.1:8080"
+	Proxy string
+	// Rules are evaluated in order
+	Rules []PACRule
+	// Default is the result if no rule matches
+	Default string
+}
+
+// PACRule is a JavaScript condition and the PAC result if it holds.
+type PACRule struct {
+	Condition string
+	Result    string
+}
+
+var defaultPACTemplate = template.Must(template.New("pac").Funcs(template.FuncMap{"jsString": jsString}).Parse(`function portOf(url) {
+	var m = /^[a-z][a-z0-9+.-]*:\/\/(?:[^\/?#@]*@)?(?:\[[^\]]*\]|[^\/?#:]*):([0-9]+)/i.exec(url);
+	if (m) {
+		return parseInt(m[1], 10);
+	}
+	return /^(https|wss):/i.test(url) ? 443 : 80;
+}
+
+function FindProxyForURL(url, host) {
+	var port = portOf(url);
+{{- range .Rules}}
+	if ({{.Condition}}) {
+		return {{jsString .Result}};
+	}
+{{- end}}
+	return {{jsString .Default}};
+}
+`))
+
+func (p *PAC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data := p.Data(r)
+	tmpl := p.Template
+	if tmpl == nil {
+		tmpl = defaultPACTemplate
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	maxAge := p.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultPACMaxAge
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	header := w.Header()
+	header.Set("Content-Type", PACContentType)
+	header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+	header.Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// Data returns the data the file is generated from.
+func (p *PAC) Data(r *http.Request) *PACData {
+	proxy := p.Proxy
+	if proxy == "" {
+		proxy = r.Host
+	}
+	scheme := "PROXY"
+	if r.TLS != nil {
+		scheme = "HTTPS"
+	}
+	data := &PACData{
+		Proxy: scheme + " " + proxy,
+	}
+	data.Default = data.Proxy
+
+	for _, pattern := range p.Bypass {
+		data.Rules = append(data.Rules, PACRule{
+			Condition: pacHostCondition(pattern),
+			Result:    "DIRECT",
+		})
+	}
+
+	if p.Router != nil && p.BypassDirectRoutes {
+		for _, rule := range p.Router.Rules {
+			direct := rule.Route == Direct
+			cond, exact := pacRuleCondition(&rule)
+			switch {
+			case direct && exact:
+				data.Rules = append(data.Rules, PACRule{Condition: cond, Result: "DIRECT"})
+			case !direct:
+				// A superset of the rule still sends its traffic to the proxy.
+				data.Rules = append(data.Rules, PACRule{Condition: cond, Result: data.Proxy})
+			}
+		}
+		if p.Router.Default == "" || p.Router.Default == Direct {
+			data.Default = "DIRECT"
+		}
+	}
+	return data
+}
+
+// pacRuleCondition returns the JavaScript condition of the rule,
+// exact is false if the condition is a superset of the rule.
+func pacRuleCondition(rule *Rule) (cond string, exact bool) {
+	exact = len(rule.Identities) == 0
+	var conds []string
+	if len(rule.Hosts) != 0 {
+		hosts := make([]string, 0, len(rule.Hosts))
+		for _, pattern := range rule.Hosts {
+			hosts = append(hosts, pacHostCondition(pattern))
+		}
+		conds = append(conds, "("+strings.Join(hosts, " || ")+")")
+	}
+	if len(rule.CIDRs) != 0 {
+		var nets []string
+		for _, prefix := range rule.CIDRs {
+			if !prefix.Addr().Is4() {
+				exact = false
+				continue
+			}
+			mask := net.CIDRMask(prefix.Bits(), 32)
+			nets = append(nets, fmt.Sprintf("isInNet(host, %s, %s)",
+				jsString(prefix.Masked().Addr().String()), jsString(net.IP(mask).String())))
+		}
+		if len(nets) != 0 {
+			// Rules only match literal addresses, isInNet would resolve host names.
+			conds = append(conds, `(/^[0-9.]+$/.test(host) && (`+strings.Join(nets, " || ")+"))")
+		} else if exact {
+			conds = append(conds, "false")
+		}
+	}
+	if len(rule.Ports) != 0 {
+		ports := make([]string, 0, len(rule.Ports))
+		for _, p := range rule.Ports {
+			lo, hi, isRange := strings.Cut(p, "-")
+			min, err1 := strconv.ParseUint(lo, 10, 16)
+			max, err2 := strconv.ParseUint(hi, 10, 16)
+			switch {
+			case !isRange && err1 == nil:
+				ports = append(ports, fmt.Sprintf("port == %d", min))
+			case isRange && err1 == nil && err2 == nil:
+				ports = append(ports, fmt.Sprintf("(port >= %d && port <= %d)", min, max))
+			}
+		}
+		if len(ports) == 0 {
+			ports = append(ports, "false")
+		}
+		conds = append(conds, "("+strings.Join(ports, " || ")+")")
+	}
+	if len(conds) == 0 {
+		return "true", exact
+	}
+	return strings.Join(conds, " && "), exact
+}
+
+// pacHostCondition returns the JavaScript condition of a host pattern.
+func pacHostCondition(pattern string) string {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*" {
+		return "true"
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return "dnsDomainIs(host, " + jsString("."+suffix) + ")"
+	}
+	return "host == " + jsString(pattern)
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
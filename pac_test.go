@@ -0,0 +1,100 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestPAC(t *testing.T) {
+	proxy := httptest.NewServer(&ProxyHandler{
+		Router: &Router{
+			Upstreams: map[string]*Dialer{"parent": {Proxy: "parent.test:3128"}},
+			Rules: []Rule{
+				{Hosts: []string{"*.parent.test"}, Identities: []string{"alice"}, Route: "parent"},
+				{Hosts: []string{"intranet.test"}, Ports: []string{"80", "8000-8999"}, Route: Direct},
+				{CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Route: Direct},
+				{Identities: []string{"bob"}, Route: Direct},
+			},
+			Default: "parent",
+		},
+		PAC: &PAC{
+			BypassDirectRoutes: true,
+			Bypass:             []string{"*.corp.test"},
+		},
+	})
+	defer proxy.Close()
+	host := strings.TrimPrefix(proxy.URL, "http://")
+
+	resp, err := http.Get(proxy.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != PACContentType {
+		t.Fatal(resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(resp.Header.Get("Cache-Control"), "max-age=3600") {
+		t.Fatal(resp.Header.Get("Cache-Control"))
+	}
+
+	pac := string(body)
+	for _, want := range []string{
+		`if (dnsDomainIs(host, ".corp.test")) {
+		return "DIRECT";`,
+		`if ((dnsDomainIs(host, ".parent.test"))) {
+		return "PROXY ` + host + `";`,
+		`if ((host == "intranet.test") && (port == 80 || (port >= 8000 && port <= 8999))) {
+		return "DIRECT";`,
+		`isInNet(host, "10.0.0.0", "255.0.0.0")`,
+		`return "PROXY ` + host + `";
+}`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("missing %q in\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, "bob") {
+		t.Error("rule depending on identity bypasses the proxy")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/wpad.dat", nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatal(resp.Status)
+	}
+}
+
+func TestPACTemplate(t *testing.T) {
+	pac := &PAC{
+		Proxy:    "proxy.test:8080",
+		Template: template.Must(template.New("pac").Parse(`function FindProxyForURL(url, host) { return "{{.Proxy}}; DIRECT"; }`)),
+	}
+	w := httptest.NewRecorder()
+	pac.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy.pac", nil))
+	if got := w.Body.String(); got != `function FindProxyForURL(url, host) { return "PROXY proxy.test:8080; DIRECT"; }` {
+		t.Fatal(got)
+	}
+}
+
+func TestPACEscape(t *testing.T) {
+	pac := &PAC{Bypass: []string{"*.corp.test"}}
+	r := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	r.Host = `proxy.test"; alert(1); "`
+	w := httptest.NewRecorder()
+	pac.ServeHTTP(w, r)
+	got := w.Body.String()
+	if !strings.Contains(got, `return "PROXY proxy.test\"; alert(1); \"";`) {
+		t.Fatal(got)
+	}
+}
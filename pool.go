@@ -0,0 +1,325 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects an upstream of a Pool.
+type Strategy string
+
+const (
+	// RoundRobin rotates through the upstreams.
+	RoundRobin Strategy = "round-robin"
+	// LeastConnections picks the upstream with the fewest active connections.
+	LeastConnections Strategy = "least-connections"
+	// ConsistentHash maps each destination to the same upstream while it is available.
+	ConsistentHash Strategy = "consistent-hash"
+)
+
+const (
+	// DefaultPoolMaxFails is the default number of consecutive failures before an upstream is ejected.
+	DefaultPoolMaxFails = 3
+	// DefaultPoolEjectionTime is the default time an upstream stays ejected.
+	DefaultPoolEjectionTime = 30 * time.Second
+	// DefaultHealthCheckInterval is the default interval of active health checks.
+	DefaultHealthCheckInterval = 10 * time.Second
+
+	// poolVirtualNodes is the number of points of each upstream on the hash ring.
+	poolVirtualNodes = 64
+)
+
+// ErrNoUpstream is returned when no upstream of a Pool is available.
+var ErrNoUpstream = errors.New("no upstream available")
+
+// Pool dials through one of several upstream proxies, failing over to the
+// next one when an upstream cannot be reached.
+type Pool struct {
+	// Strategy selects the upstream, RoundRobin if empty
+	Strategy Strategy
+	// MaxFails is the number of consecutive failures before an upstream is ejected, DefaultPoolMaxFails if zero
+	MaxFails int
+	// EjectionTime is how long an upstream stays ejected, DefaultPoolEjectionTime if zero
+	EjectionTime time.Duration
+	// HealthCheckTarget is the address CONNECTed to by active health checks, disabled if empty
+	HealthCheckTarget string
+	// HealthCheckInterval is the interval of active health checks, DefaultHealthCheckInterval if zero
+	HealthCheckInterval time.Duration
+	// Logger logs changes of the health of upstreams
+	Logger *slog.Logger
+
+	members []*poolMember
+	ring    []ringPoint
+	next    atomic.Uint64
+}
+
+type poolMember struct {
+	dialer       *Dialer
+	active       atomic.Int64
+	mut          sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+	unhealthy    bool
+}
+
+type ringPoint struct {
+	hash   uint32
+	member int
+}
+
+// NewPool creates a new Pool over the upstreams.
+func NewPool(upstreams ...*Dialer) *Pool {
+	p := &Pool{}
+	for i, d := range upstreams {
+		p.members = append(p.members, &poolMember{dialer: d})
+		for v := 0; v < poolVirtualNodes; v++ {
+			p.ring = append(p.ring, ringPoint{
+				hash:   hash32(d.Proxy + "#" + strconv.Itoa(v)),
+				member: i,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	return p
+}
+
+// Upstreams returns the upstreams of the pool.
+func (p *Pool) Upstreams() []*Dialer {
+	dialers := make([]*Dialer, 0, len(p.members))
+	for _, m := range p.members {
+		dialers = append(dialers, m.dialer)
+	}
+	return dialers
+}
+
+// Available reports whether the upstream is neither ejected nor failing health checks.
+func (p *Pool) Available(d *Dialer) bool {
+	for _, m := range p.members {
+		if m.dialer == d {
+			return m.available(time.Now())
+		}
+	}
+	return false
+}
+
+// DialContext connects to the address through an available upstream.
+func (p *Pool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	order := p.order(address)
+	if len(order) == 0 {
+		// Better to try the unavailable upstreams than to fail right away.
+		for i := range p.members {
+			order = append(order, i)
+		}
+	}
+	var lastErr error = ErrNoUpstream
+	for _, i := range order {
+		m := p.members[i]
+		conn, err := m.dialer.DialContext(ctx, network, address)
+		if err == nil {
+			p.succeeded(m)
+			m.active.Add(1)
+			return &poolConn{Conn: conn, member: m}, nil
+		}
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) {
+			// The upstream is fine, it refused the destination.
+			p.succeeded(m)
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		p.failed(m, err)
+		lastErr = fmt.Errorf("upstream %s: %w", m.dialer.Proxy, err)
+	}
+	return nil, lastErr
+}
+
+// Dial connects to the address through an available upstream.
+func (p *Pool) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// order returns the available members in the order they should be tried.
+func (p *Pool) order(address string) []int {
+	now := time.Now()
+	n := len(p.members)
+	order := make([]int, 0, n)
+	switch p.Strategy {
+	case LeastConnections:
+		for i, m := range p.members {
+			if m.available(now) {
+				order = append(order, i)
+			}
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return p.members[order[i]].active.Load() < p.members[order[j]].active.Load()
+		})
+	case ConsistentHash:
+		if len(p.ring) == 0 {
+			return nil
+		}
+		h := hash32(address)
+		start := sort.Search(len(p.ring), func(i int) bool {
+			return p.ring[i].hash >= h
+		})
+		seen := make([]bool, n)
+		for i := 0; i < len(p.ring) && len(order) < n; i++ {
+			point := p.ring[(start+i)%len(p.ring)]
+			if seen[point.member] {
+				continue
+			}
+			seen[point.member] = true
+			if p.members[point.member].available(now) {
+				order = append(order, point.member)
+			}
+		}
+	default:
+		start := int((p.next.Add(1) - 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			j := (start + i) % n
+			if p.members[j].available(now) {
+				order = append(order, j)
+			}
+		}
+	}
+	return order
+}
+
+func (p *Pool) maxFails() int {
+	if p.MaxFails > 0 {
+		return p.MaxFails
+	}
+	return DefaultPoolMaxFails
+}
+
+func (p *Pool) ejectionTime() time.Duration {
+	if p.EjectionTime > 0 {
+		return p.EjectionTime
+	}
+	return DefaultPoolEjectionTime
+}
+
+func (p *Pool) succeeded(m *poolMember) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.fails = 0
+}
+
+func (p *Pool) failed(m *poolMember, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.fails++
+	if m.fails < p.maxFails() {
+		return
+	}
+	m.fails = 0
+	m.ejectedUntil = time.Now().Add(p.ejectionTime())
+	if p.Logger != nil {
+		p.Logger.Warn("upstream ejected", "upstream", m.dialer.Proxy, "err", err)
+	}
+}
+
+// RunHealthCheck actively checks the upstreams until ctx is done.
+func (p *Pool) RunHealthCheck(ctx context.Context) error {
+	if p.HealthCheckTarget == "" {
+		return errors.New("no health check target")
+	}
+	interval := p.HealthCheckInterval
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.CheckHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHealth checks every upstream once by CONNECTing to HealthCheckTarget.
+func (p *Pool) CheckHealth(ctx context.Context) {
+	interval := p.HealthCheckInterval
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			defer cancel()
+			conn, err := m.dialer.DialContext(checkCtx, "tcp", p.HealthCheckTarget)
+			if err == nil {
+				conn.Close()
+			}
+			m.mut.Lock()
+			defer m.mut.Unlock()
+			unhealthy := err != nil
+			if unhealthy != m.unhealthy && p.Logger != nil {
+				if unhealthy {
+					p.Logger.Warn("upstream unhealthy", "upstream", m.dialer.Proxy, "err", err)
+				} else {
+					p.Logger.Info("upstream healthy", "upstream", m.dialer.Proxy)
+				}
+			}
+			m.unhealthy = unhealthy
+			if !unhealthy {
+				m.fails = 0
+				m.ejectedUntil = time.Time{}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *poolMember) available(now time.Time) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return !m.unhealthy && !now.Before(m.ejectedUntil)
+}
+
+// poolConn counts the active connections of an upstream.
+type poolConn struct {
+	net.Conn
+	member *poolMember
+	once   sync.Once
+}
+
+func (c *poolConn) netConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (c *poolConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() {
+		c.member.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,149 @@
+package httpproxy
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+type countingProxy struct {
+	*httptest.Server
+	hits atomic.Int32
+}
+
+func newCountingProxy() *countingProxy {
+	p := &countingProxy{}
+	handler := &ProxyHandler{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.hits.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	return p
+}
+
+func deadProxyURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func newTestPool(t *testing.T, urls ...string) *Pool {
+	var dialers []*Dialer
+	for _, u := range urls {
+		d, err := NewDialer(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialers = append(dialers, d)
+	}
+	return NewPool(dialers...)
+}
+
+func TestPoolFailover(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer target.Close()
+	p1 := newCountingProxy()
+	defer p1.Close()
+	p2 := newCountingProxy()
+	defer p2.Close()
+
+	pool := newTestPool(t, deadProxyURL(t), p1.URL, p2.URL)
+	pool.MaxFails = 1
+	dead := pool.Upstreams()[0]
+
+	for i := 0; i != 6; i++ {
+		conn, err := pool.Dial("tcp", target.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if pool.Available(dead) {
+		t.Fatal("dead upstream not ejected")
+	}
+	if p1.hits.Load() == 0 || p2.hits.Load() == 0 {
+		t.Fatal("round robin not balanced", p1.hits.Load(), p2.hits.Load())
+	}
+}
+
+func TestPoolRoundRobinWrap(t *testing.T) {
+	pool := newTestPool(t, deadProxyURL(t), deadProxyURL(t), deadProxyURL(t))
+	// The counter wraps around instead of indexing out of range.
+	pool.next.Store(math.MaxUint64)
+	for _, want := range [][]int{{0, 1, 2}, {0, 1, 2}, {1, 2, 0}} {
+		if got := pool.order(""); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer target.Close()
+	p1 := newCountingProxy()
+	defer p1.Close()
+	p2 := newCountingProxy()
+	defer p2.Close()
+
+	pool := newTestPool(t, p1.URL, p2.URL)
+	pool.Strategy = ConsistentHash
+	for i := 0; i != 5; i++ {
+		conn, err := pool.Dial("tcp", target.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if h1, h2 := p1.hits.Load(), p2.hits.Load(); h1 != 0 && h2 != 0 {
+		t.Fatal("same destination spread over upstreams", h1, h2)
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer target.Close()
+	p1 := newCountingProxy()
+	defer p1.Close()
+	p2 := newCountingProxy()
+	defer p2.Close()
+
+	pool := newTestPool(t, p1.URL, p2.URL)
+	pool.Strategy = LeastConnections
+	conn1, err := pool.Dial("tcp", target.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close()
+	conn2, err := pool.Dial("tcp", target.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if p1.hits.Load() != 1 || p2.hits.Load() != 1 {
+		t.Fatal("busy upstream picked", p1.hits.Load(), p2.hits.Load())
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer target.Close()
+	p1 := newCountingProxy()
+	defer p1.Close()
+
+	pool := newTestPool(t, deadProxyURL(t), p1.URL)
+	pool.HealthCheckTarget = target.Listener.Addr().String()
+	pool.CheckHealth(context.Background())
+
+	upstreams := pool.Upstreams()
+	if pool.Available(upstreams[0]) || !pool.Available(upstreams[1]) {
+		t.Fatal("health check mismatch")
+	}
+}
@@ -3,10 +3,18 @@ package httpproxy
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ProxyHandler proxy handler
@@ -20,46 +28,239 @@ type ProxyHandler struct {
 	Authentication Authentication
 	// NotFound Not proxy requests
 	NotFound http.Handler
-	// Logger error log
-	Logger Logger
-	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	// Logger logs errors with their level, nothing is logged if nil
+	Logger *slog.Logger
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer,
+	// a shared pool of 32KiB buffers if nil
 	BytesPool BytesPool
+	// UDPURITemplate is the URI template of CONNECT-UDP, DefaultUDPURITemplate if empty
+	UDPURITemplate string
+	// UDPRelay enables the UDP relay, its peers are dialed like CONNECT-UDP destinations
+	UDPRelay bool
+	// UDPRelayIdleTimeout closes a UDP relay association without traffic, DefaultUDPRelayIdleTimeout if zero
+	UDPRelayIdleTimeout time.Duration
+	// UDPRelayMaxPeers limits the number of peers of a UDP relay association, unlimited if zero
+	UDPRelayMaxPeers int
+	// Reverse enables reverse tunnels, CONNECTs to a registered endpoint are forwarded to its client
+	Reverse *ReverseRegistry
+	// Upstream is the optional parent proxy, it takes precedence over ProxyDial.
+	// Tunnels use CONNECT and absolute-form requests are forwarded as-is.
+	Upstream *Dialer
+	// Router picks the upstream per destination, it takes precedence over Upstream
+	Router *Router
+	// CircuitBreaker fails fast for destination hosts and upstreams that keep failing
+	CircuitBreaker *CircuitBreaker
+	// PAC serves /proxy.pac and /wpad.dat for requests that are not proxied
+	PAC *PAC
+	// DirectDialer connects to destinations without an upstream if ProxyDial is nil,
+	// a DirectDialer with the shared DefaultResolver if nil
+	DirectDialer *DirectDialer
+
+	// Limiter limits the requests and tunnels per source IP and identity
+	Limiter *Limiter
+	// Observer is notified about the lifecycle of requests, tunnels and dials
+	Observer Observer
+	// Tracer records a span per request and tunnel and propagates the trace context
+	Tracer *Tracer
+	// Accounting counts the traffic per identity and destination and enforces quotas
+	Accounting *Accounting
+	// Shaper limits the bandwidth of tunnels, proxied requests and UDP datagrams.
+	// Tunnels with a shaper are copied through buffers instead of spliced.
+	Shaper *Shaper
+
+	// TunnelLinger is how long a tunnel waits for the other direction once one direction finished, DefaultTunnelLinger if zero
+	TunnelLinger time.Duration
+	// TunnelIdleTimeout closes a tunnel or CONNECT-UDP without traffic in either direction
+	// and ends the response of a proxied request without traffic, also with Client, no timeout if zero.
+	// Tunnels with an idle timeout are copied through buffers instead of spliced.
+	TunnelIdleTimeout time.Duration
+	// TunnelMaxDuration is the maximum lifetime of a tunnel, CONNECT-UDP or UDP relay association
+	// and of the response of a proxied request, also with Client, unlimited if zero
+	TunnelMaxDuration time.Duration
+
+	// DialTimeout is the maximum amount of time a dial to a destination or upstream will wait, no timeout if zero
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout is the maximum amount of time to wait for the TLS handshake
+	// of a proxied request, no timeout if zero
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout is the maximum amount of time to wait for the response headers
+	// of a proxied request, no timeout if zero
+	ResponseHeaderTimeout time.Duration
+
+	// Source selects the local address of direct connections if ProxyDial is nil,
+	// routes naming one of Router.Sources use that one instead
+	Source *SourceAddress
 }
 
+const (
+	// ProxyStatusKey is the header reporting how the proxy handled a request (RFC 9209).
+	ProxyStatusKey = "Proxy-Status"
+
+	proxyStatusName = "httpproxy"
+)
+
+// errDialTimeout is the cause of dials canceled by DialTimeout.
+var errDialTimeout = errors.New("dial timeout")
+
+// Logger is the former type of the loggers.
+//
+// Deprecated: the loggers are *slog.Logger, a *log.Logger can be wrapped
+// with slog.New(slog.NewTextHandler(l.Writer(), nil)).
 type Logger interface {
 	Println(v ...interface{})
 }
 
 func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Observer != nil || p.Tracer != nil {
+		var done func(*http.Request)
+		w, r, done = p.observe(w, r)
+		defer func() { done(r) }()
+	}
+	var proxy func(http.ResponseWriter, *http.Request)
+	tunnel := true
 	switch {
+	case isExtendedConnect(r):
+		proxy = p.proxyExtendedConnect
+	case isConnectUDP(r):
+		proxy = p.proxyConnectUDP
+	case p.UDPRelay && isUDPRelay(r):
+		proxy = p.proxyUDPRelay
+	case p.Reverse != nil && isReverseTunnel(r):
+		proxy = p.proxyReverseTunnel
 	case r.Method == http.MethodConnect:
-		if p.Authentication != nil && !p.Authentication.Auth(w, r) {
-			return
-		}
-		p.proxyConnect(w, r)
+		proxy = p.proxyConnect
 	case r.URL.Host != "":
-		if p.Authentication != nil && !p.Authentication.Auth(w, r) {
-			return
+		proxy = p.proxyOther
+		tunnel = false
+	case p.PAC != nil && isPACPath(r.URL.Path):
+		pac := *p.PAC
+		if pac.Router == nil {
+			pac.Router = p.Router
 		}
-		p.proxyOther(w, r)
+		pac.ServeHTTP(w, r)
+		return
 	default:
 		handle := p.NotFound
 		if handle == nil {
 			handle = http.HandlerFunc(http.NotFound)
 		}
 		handle.ServeHTTP(w, r)
+		return
+	}
+	if p.Limiter != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		release, ok := p.limit(w, "ip:"+host, p.Limiter.PerIP, tunnel)
+		if !ok {
+			return
+		}
+		defer release()
 	}
+	req, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	r = req
+	if p.Limiter != nil {
+		if identity := IdentityFromContext(r.Context()); identity != "" {
+			release, ok := p.limit(w, "identity:"+identity, p.Limiter.PerIdentity, tunnel)
+			if !ok {
+				return
+			}
+			defer release()
+		}
+	}
+	if p.Accounting != nil && !p.checkQuota(w, r) {
+		return
+	}
+	proxy(w, r)
+}
+
+// authenticate checks the credentials of the request, the returned request
+// carries the identity of the client.
+func (p *ProxyHandler) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if p.Authentication == nil {
+		return r, true
+	}
+	span := spanFromContext(r.Context()).startChild("auth")
+	if !p.Authentication.Auth(w, r) {
+		span.end(errAuthFailed)
+		if p.Observer != nil {
+			p.Observer.AuthFailure(r)
+		}
+		return nil, false
+	}
+	username, _, ok := parseBasicAuth(r.Header.Get(ProxyAuthorizationKey))
+	if ok {
+		r = r.WithContext(ContextWithIdentity(r.Context(), username))
+	}
+	span.end(nil)
+	if p.Observer != nil {
+		p.Observer.AuthSuccess(r, username)
+	}
+	return r, true
 }
 
 func (p *ProxyHandler) proxyOther(w http.ResponseWriter, r *http.Request) {
+	address := canonicalAddr(r.URL)
 	r = r.Clone(r.Context())
 	r.RequestURI = ""
+	// The credentials are for this proxy.
+	r.Header.Del(ProxyAuthorizationKey)
+	span := spanFromContext(r.Context())
+	if span != nil {
+		r = r.WithContext(span.clientTrace(r.Context()))
+		// The destination continues the trace below the span of the proxy.
+		r.Header.Set(TraceparentKey, span.Traceparent())
+	}
+	// The limits of tunnels end the response, whichever client sends the request.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	r = r.WithContext(ctx)
+	var activity *atomic.Int64
+	if p.TunnelIdleTimeout > 0 {
+		activity = &atomic.Int64{}
+	}
+
+	var reqBody *requestBody
+	var uploaded *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		reqBody = &requestBody{Reader: r.Body, body: r.Body, done: make(chan struct{})}
+		r.Body = reqBody
+		// The transport may still read the body once the response arrived,
+		// it must be done with it before the handler returns.
+		defer reqBody.wait()
+		if p.Accounting != nil || p.Observer != nil || p.Tracer != nil {
+			uploaded = &countingReader{Reader: reqBody.Reader}
+			reqBody.Reader = uploaded
+		}
+		if activity != nil {
+			reqBody.Reader = &activityReader{reqBody.Reader, activity}
+		}
+	}
+	var shaped *shapedConn
+	if p.Shaper != nil {
+		shaped = p.Shaper.open(IdentityFromContext(r.Context()))
+		defer shaped.close()
+		// The waits end once the client is gone.
+		stop := context.AfterFunc(r.Context(), shaped.close)
+		defer stop()
+		if reqBody != nil {
+			reqBody.Reader = shaped.shapeUpload(reqBody.Reader)
+		}
+	}
 
 	resp, err := p.client().Do(r)
 	if err != nil {
+		p.recordRequest(r.Context(), address, 0, 0, err)
+		if p.circuitOpen(w, err) {
+			return
+		}
 		e := err.Error()
 		if p.Logger != nil {
-			p.Logger.Println(e)
+			p.Logger.Error(e)
 		}
 		http.Error(w, e, http.StatusInternalServerError)
 		return
@@ -70,19 +271,64 @@ func (p *ProxyHandler) proxyOther(w http.ResponseWriter, r *http.Request) {
 		header[k] = v
 	}
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	var body io.Reader = resp.Body
+	if p.TunnelMaxDuration > 0 {
+		timer := time.AfterFunc(p.TunnelMaxDuration, func() { cancel(errTunnelMaxDuration) })
+		defer timer.Stop()
+	}
+	if activity != nil {
+		activity.Store(time.Now().UnixNano())
+		body = &activityReader{body, activity}
+		go p.idleTimeout(ctx, cancel, activity)
+	}
+	if shaped != nil {
+		body = shaped.shapeDownload(body)
+	}
+	transfer := span.startChild("transfer")
+	n, err := io.Copy(w, body)
+	if cause := context.Cause(ctx); err != nil && (cause == errTunnelIdleTimeout || cause == errTunnelMaxDuration) {
+		err = cause
+	}
+	var upload int64
+	if uploaded != nil {
+		upload = uploaded.n.Load()
+	}
+	transfer.setAttributes(Attribute{"httpproxy.upload", upload}, Attribute{"httpproxy.download", n})
+	transfer.end(err)
+	p.account(r, address, upload, n)
 	if err != nil && p.Logger != nil {
-		p.Logger.Println(err)
+		p.Logger.Warn("copy response failed", "address", address, "err", err)
 	}
+	p.recordRequest(r.Context(), address, upload, n, err)
 	return
 }
 
+// idleTimeout cancels ctx with errTunnelIdleTimeout once there was no
+// activity for TunnelIdleTimeout, it returns when ctx is done.
+func (p *ProxyHandler) idleTimeout(ctx context.Context, cancel context.CancelCauseFunc, activity *atomic.Int64) {
+	timer := time.NewTimer(p.TunnelIdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if d := time.Since(time.Unix(0, activity.Load())); d < p.TunnelIdleTimeout {
+			timer.Reset(p.TunnelIdleTimeout - d)
+			continue
+		}
+		cancel(errTunnelIdleTimeout)
+		return
+	}
+}
+
 func (p *ProxyHandler) proxyConnect(w http.ResponseWriter, r *http.Request) {
 	hijacker, ok := w.(http.Hijacker)
-	if !ok {
+	if !ok && r.ProtoMajor != 2 {
 		e := "not support"
 		if p.Logger != nil {
-			p.Logger.Println(e)
+			p.Logger.Error(e)
 		}
 		http.Error(w, e, http.StatusInternalServerError)
 		return
@@ -90,9 +336,13 @@ func (p *ProxyHandler) proxyConnect(w http.ResponseWriter, r *http.Request) {
 
 	targetConn, err := p.proxyDial(r.Context(), "tcp", r.URL.Host)
 	if err != nil {
+		p.recordRequest(r.Context(), r.URL.Host, 0, 0, err)
+		if p.circuitOpen(w, err) {
+			return
+		}
 		e := fmt.Sprintf("dial %q failed: %v", r.URL.Host, err)
 		if p.Logger != nil {
-			p.Logger.Println(e)
+			p.Logger.Error(e)
 		}
 		http.Error(w, e, http.StatusInternalServerError)
 		return
@@ -101,34 +351,40 @@ func (p *ProxyHandler) proxyConnect(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 
-	conn, rw, err := hijacker.Hijack()
-	if err != nil {
-		e := fmt.Sprintf("hijack failed: %v", err)
-		if p.Logger != nil {
-			p.Logger.Println(e)
+	ctx := r.Context()
+	var clientConn io.ReadWriteCloser
+	if r.ProtoMajor == 2 {
+		// HTTP/2 cannot be hijacked, the stream itself is the tunnel.
+		clientConn, err = newStreamConn(w, r)
+		if err != nil {
+			if p.Logger != nil {
+				p.Logger.Error("open stream failed", "err", err)
+			}
+			return
 		}
-		http.Error(w, e, http.StatusInternalServerError)
-		return
-	}
-
-	clientConn := newBufConn(conn, rw)
-
-	var buf1, buf2 []byte
-	if p.BytesPool != nil {
-		buf1 = p.BytesPool.Get()
-		buf2 = p.BytesPool.Get()
-		defer func() {
-			p.BytesPool.Put(buf1)
-			p.BytesPool.Put(buf2)
-		}()
 	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			e := fmt.Sprintf("hijack failed: %v", err)
+			if p.Logger != nil {
+				p.Logger.Error(e)
+			}
+			http.Error(w, e, http.StatusInternalServerError)
+			return
+		}
+		clientConn = newBufConn(conn, rw)
+		// The server flushes the response before it stops reading in the
+		// background, a client half-closing right after the response would
+		// cancel the context. The tunnel ends with the connection instead.
+		ctx = context.WithoutCancel(ctx)
 	}
-	err = tunnel(r.Context(), targetConn, clientConn, buf1, buf2)
-	if err != nil && p.Logger != nil {
-		p.Logger.Println(err)
+
+	if p.Observer != nil {
+		p.Observer.TunnelEstablished(r, r.URL.Host)
 	}
+	start := time.Now()
+	result := p.tunnel(ctx, targetConn, clientConn)
+	p.tunnelDone(r, r.URL.Host, start, result)
 	return
 }
 
@@ -136,20 +392,282 @@ func (p *ProxyHandler) client() *http.Client {
 	if p.Client != nil {
 		return p.Client
 	}
+	transport := &http.Transport{
+		DialContext:           p.proxyDial,
+		TLSHandshakeTimeout:   p.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: p.ResponseHeaderTimeout,
+	}
+	if p.Router != nil || p.Upstream != nil {
+		transport.Proxy = p.upstreamProxy
+		transport.DialContext = p.upstreamDial
+		transport.GetProxyConnectHeader = p.upstreamConnectHeader
+	}
 	return &http.Client{
-		Transport: &http.Transport{
-			DialContext: p.proxyDial,
-		},
+		Transport: transport,
 	}
 }
 
+// route returns the name and the upstream for the destination, the upstream is nil for dialing directly.
+func (p *ProxyHandler) route(ctx context.Context, address string) (string, *Dialer, error) {
+	if p.Reverse != nil {
+		if _, ok := p.Reverse.lookup(address); ok {
+			return Direct, nil, nil
+		}
+	}
+	if p.Router != nil {
+		return p.Router.Route(ctx, address)
+	}
+	if p.Upstream == nil {
+		return Direct, nil, nil
+	}
+	return "", p.Upstream, nil
+}
+
+// source returns the source address of direct connections of the route.
+func (p *ProxyHandler) source(name string) *SourceAddress {
+	if p.Router != nil {
+		if source, ok := p.Router.Sources[name]; ok {
+			return source
+		}
+	}
+	return p.Source
+}
+
+// upstream returns the upstream whose proxy address is address.
+func (p *ProxyHandler) upstream(address string) (*Dialer, bool) {
+	if p.Router != nil {
+		return p.Router.upstream(address)
+	}
+	if p.Upstream != nil && p.Upstream.Proxy == address {
+		return p.Upstream, true
+	}
+	return nil, false
+}
+
+// upstreamProxy returns the upstream for a request, nil for dialing directly.
+func (p *ProxyHandler) upstreamProxy(r *http.Request) (*url.URL, error) {
+	_, d, err := p.route(r.Context(), canonicalAddr(r.URL))
+	if err != nil || d == nil {
+		return nil, err
+	}
+	return d.proxyURL(), nil
+}
+
+// upstreamConnectHeader returns the headers for a CONNECT to an upstream.
+func (p *ProxyHandler) upstreamConnectHeader(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+	d, ok := p.upstream(proxyURL.Host)
+	if !ok {
+		return nil, nil
+	}
+	return d.proxyHeader(), nil
+}
+
+// upstreamDial connects to the upstream when the transport dials it,
+// anything else is dialed through its route.
+func (p *ProxyHandler) upstreamDial(ctx context.Context, network, address string) (net.Conn, error) {
+	if d, ok := p.upstream(address); ok {
+		if p.DialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeoutCause(ctx, p.DialTimeout, errDialTimeout)
+			defer cancel()
+		}
+		return p.observedDial(ctx, "", address, network, address, func(ctx context.Context) (net.Conn, error) {
+			if p.CircuitBreaker != nil {
+				return p.upstreamBreakerDial(ctx, d, network, address)
+			}
+			return d.proxyDial(ctx, network, address)
+		})
+	}
+	return p.proxyDial(ctx, network, address)
+}
+
+// upstreamBreakerDial connects to the upstream guarded by its circuit, the
+// connection is shared by the destinations of the proxied requests.
+func (p *ProxyHandler) upstreamBreakerDial(ctx context.Context, d *Dialer, network, address string) (net.Conn, error) {
+	done, err := p.CircuitBreaker.Allow("upstream:" + d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.proxyDial(ctx, network, address)
+	outcome := OutcomeSuccess
+	switch {
+	case err == nil:
+	case ctx.Err() != nil && context.Cause(ctx) != errDialTimeout:
+		// Canceled by the client, unlike the expiry of DialTimeout.
+		outcome = OutcomeIgnored
+	default:
+		outcome = OutcomeFailure
+	}
+	done(outcome)
+	return conn, err
+}
+
 func (p *ProxyHandler) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
-	proxyDial := p.ProxyDial
-	if proxyDial == nil {
-		var dialer net.Dialer
-		proxyDial = dialer.DialContext
+	if p.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, p.DialTimeout, errDialTimeout)
+		defer cancel()
+	}
+	name, d, err := p.route(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		if source := p.source(name); source != nil {
+			ctx = contextWithSource(ctx, source)
+		}
+	}
+	var upstream string
+	if d != nil {
+		upstream = d.Proxy
 	}
-	return proxyDial(ctx, network, address)
+	return p.observedDial(ctx, name, upstream, network, address, func(ctx context.Context) (net.Conn, error) {
+		if p.CircuitBreaker != nil {
+			return p.breakerDial(ctx, d, network, address)
+		}
+		return p.dialVia(ctx, d, network, address)
+	})
+}
+
+// dialVia connects to the destination through the upstream, directly if nil.
+func (p *ProxyHandler) dialVia(ctx context.Context, d *Dialer, network, address string) (net.Conn, error) {
+	if d != nil {
+		switch network {
+		case "udp", "udp4", "udp6":
+			conn, err := d.DialUDPContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return conn.(net.Conn), nil
+		}
+		return d.DialContext(ctx, network, address)
+	}
+	return p.directDial(ctx, network, address)
+}
+
+// breakerDial dials guarded by the circuits of the destination host and of the upstream.
+func (p *ProxyHandler) breakerDial(ctx context.Context, d *Dialer, network, address string) (net.Conn, error) {
+	hostDone, err := p.CircuitBreaker.Allow("host:" + hostOf(address))
+	if err != nil {
+		return nil, err
+	}
+	upstreamDone := func(Outcome) {}
+	if d != nil {
+		upstreamDone, err = p.CircuitBreaker.Allow("upstream:" + d.Proxy)
+		if err != nil {
+			hostDone(OutcomeIgnored)
+			return nil, err
+		}
+	}
+
+	conn, err := p.dialVia(ctx, d, network, address)
+
+	hostOutcome, upstreamOutcome := OutcomeSuccess, OutcomeSuccess
+	var connectErr *ConnectError
+	switch {
+	case err == nil:
+	case ctx.Err() != nil && context.Cause(ctx) != errDialTimeout:
+		// Canceled by the client, unlike the expiry of DialTimeout.
+		hostOutcome, upstreamOutcome = OutcomeIgnored, OutcomeIgnored
+	case d == nil:
+		hostOutcome = OutcomeFailure
+	case errors.As(err, &connectErr):
+		// The upstream answered, the destination may be at fault.
+		hostOutcome = OutcomeIgnored
+		if connectErr.StatusCode >= http.StatusInternalServerError {
+			hostOutcome = OutcomeFailure
+		}
+	default:
+		hostOutcome, upstreamOutcome = OutcomeIgnored, OutcomeFailure
+	}
+	hostDone(hostOutcome)
+	upstreamDone(upstreamOutcome)
+	return conn, err
+}
+
+// circuitOpen fails fast for dials rejected by the circuit breaker,
+// reporting whether the error was handled.
+func (p *ProxyHandler) circuitOpen(w http.ResponseWriter, err error) bool {
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) {
+		return false
+	}
+	e := openErr.Error()
+	if p.Logger != nil {
+		p.Logger.Warn(e)
+	}
+	header := w.Header()
+	header.Set(ProxyStatusKey, fmt.Sprintf("%s; error=destination_unavailable; details=%s", proxyStatusName, strconv.Quote(e)))
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(openErr.RetryAfter.Seconds()))))
+	http.Error(w, e, http.StatusServiceUnavailable)
+	return true
+}
+
+// directDial connects to the destination without an upstream.
+func (p *ProxyHandler) directDial(ctx context.Context, network, address string) (net.Conn, error) {
+	if p.Reverse != nil {
+		conn, err := p.Reverse.DialContext(ctx, network, address)
+		if err != ErrReverseTunnelNotFound {
+			return conn, err
+		}
+	}
+	if p.ProxyDial != nil {
+		return p.ProxyDial(ctx, network, address)
+	}
+	if p.DirectDialer != nil {
+		return p.DirectDialer.DialContext(ctx, network, address)
+	}
+	return defaultDirectDialer.DialContext(ctx, network, address)
+}
+
+// defaultDirectDialer resolves with the shared DefaultResolver,
+// the source address is taken from the context.
+var defaultDirectDialer = &DirectDialer{}
+
+// canonicalAddr returns the host:port of u, adding the default port of the scheme.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// requestBody is the body of a proxied request. It stays at EOF once reached,
+// the server closes the body of the client when the response is written while
+// the transport may still check the body for its end.
+type requestBody struct {
+	io.Reader
+	body io.Closer
+	eof  bool
+	once sync.Once
+	done chan struct{}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.eof {
+		return 0, io.EOF
+	}
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// Close closes the body of the client, the transport closes it once done.
+func (b *requestBody) Close() error {
+	err := b.body.Close()
+	b.once.Do(func() { close(b.done) })
+	return err
+}
+
+// wait waits until the transport is done with the body.
+func (b *requestBody) wait() {
+	<-b.done
 }
 
 func newBufConn(conn net.Conn, rw *bufio.ReadWriter) net.Conn {
@@ -168,6 +686,16 @@ type bufConn struct {
 	*bufio.Reader
 }
 
+// netConn returns the wrapped connection, only valid once the buffer is drained.
+func (c *bufConn) netConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (c *bufConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
 func (c *bufConn) Read(p []byte) (int, error) {
 	if c.Reader == nil {
 		return c.Conn.Read(p)
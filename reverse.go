@@ -0,0 +1,567 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// ReverseTunnelNameKey is the header carrying the endpoint a reverse tunnel registers.
+	ReverseTunnelNameKey = "Reverse-Tunnel-Name"
+
+	// reverseTunnelProtocol is the upgrade token of reverse tunnels.
+	reverseTunnelProtocol = "reverse-tunnel"
+)
+
+var (
+	// ErrReverseTunnelNotFound is returned when no client is registered for an address.
+	ErrReverseTunnelNotFound = errors.New("reverse tunnel not found")
+	// ErrReverseTunnelExists is returned when an endpoint is already registered.
+	ErrReverseTunnelExists = errors.New("reverse tunnel already exists")
+)
+
+// isReverseTunnel reports whether r is a request to register a reverse tunnel.
+func isReverseTunnel(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerContainsToken(r.Header["Connection"], "upgrade") &&
+		headerContainsToken(r.Header["Upgrade"], reverseTunnelProtocol)
+}
+
+// ReverseRegistry holds the clients that expose listeners through the proxy.
+// An endpoint is either a name, matching the host of any port, or a host:port.
+// Each client connection is multiplexed with HTTP/2, every forwarded
+// connection is a CONNECT stream from the proxy to the client.
+//
+// Registrations are rejected unless the host of the endpoint matches one of
+// Domains or Authorize allows it.
+type ReverseRegistry struct {
+	// Domains are the host patterns any client may register, like the Hosts of a Rule, e.g. "*.tunnel.example.com"
+	Domains []string
+	// Authorize reports whether the client with identity may register name
+	Authorize func(identity, name string) bool
+
+	mut      sync.RWMutex
+	sessions map[string]*http2.ClientConn
+}
+
+// NewReverseRegistry creates a new ReverseRegistry
+func NewReverseRegistry() *ReverseRegistry {
+	return &ReverseRegistry{
+		sessions: map[string]*http2.ClientConn{},
+	}
+}
+
+// Names returns the registered endpoints.
+func (r *ReverseRegistry) Names() []string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	names := make([]string, 0, len(r.sessions))
+	for name := range r.sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// allowed reports whether the client with identity may register name.
+func (r *ReverseRegistry) allowed(identity, name string) bool {
+	host := hostOf(name)
+	if matchAny(r.Domains, func(pattern string) bool {
+		return matchHost(pattern, host)
+	}) {
+		return true
+	}
+	return r.Authorize != nil && r.Authorize(identity, name)
+}
+
+// reserve claims name, the session is set once the client is connected.
+func (r *ReverseRegistry) reserve(name string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if _, ok := r.sessions[name]; ok {
+		return ErrReverseTunnelExists
+	}
+	r.sessions[name] = nil
+	return nil
+}
+
+func (r *ReverseRegistry) set(name string, cc *http2.ClientConn) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.sessions[name] = cc
+}
+
+func (r *ReverseRegistry) unregister(name string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	delete(r.sessions, name)
+}
+
+func (r *ReverseRegistry) lookup(address string) (*http2.ClientConn, bool) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	if cc := r.sessions[address]; cc != nil {
+		return cc, true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	cc := r.sessions[host]
+	return cc, cc != nil
+}
+
+// DialContext connects to the address through the client registered for it.
+func (r *ReverseRegistry) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	cc, ok := r.lookup(address)
+	if !ok {
+		return nil, ErrReverseTunnelNotFound
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: http.Header{},
+		Body:   pr,
+	}
+	// The stream outlives ctx once connected, it is canceled when the dial is
+	// abandoned or the connection is closed.
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	req = req.WithContext(streamCtx)
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := cc.RoundTrip(req)
+		ch <- result{resp, err}
+	}()
+
+	var res result
+	select {
+	case <-ctx.Done():
+		cancel()
+		pw.CloseWithError(ctx.Err())
+		go func() {
+			if res := <-ch; res.resp != nil {
+				res.resp.Body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case res = <-ch:
+	}
+	if res.err != nil {
+		cancel()
+		pw.Close()
+		return nil, res.err
+	}
+	if res.resp.StatusCode != http.StatusOK {
+		res.resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, fmt.Errorf("failed reverse proxying %d: %s", res.resp.StatusCode, res.resp.Status)
+	}
+	return &pipeConn{
+		ReadCloser: res.resp.Body,
+		w:          pw,
+		cancel:     cancel,
+		localAddr:  &hostPortAddr{network: network, address: "reverse"},
+		remoteAddr: &hostPortAddr{network: network, address: address},
+	}, nil
+}
+
+// proxyReverseTunnel registers the client as a reverse tunnel until it disconnects.
+func (p *ProxyHandler) proxyReverseTunnel(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(ReverseTunnelNameKey)
+	if name == "" {
+		e := "missing " + ReverseTunnelNameKey
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusBadRequest)
+		return
+	}
+	if !p.Reverse.allowed(IdentityFromContext(r.Context()), name) {
+		e := fmt.Sprintf("register %q forbidden", name)
+		if p.Logger != nil {
+			p.Logger.Warn(e)
+		}
+		http.Error(w, e, http.StatusForbidden)
+		return
+	}
+	err := p.Reverse.reserve(name)
+	if err != nil {
+		e := fmt.Sprintf("register %q failed: %v", name, err)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusConflict)
+		return
+	}
+	defer p.Reverse.unregister(name)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		e := "not support"
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		e := fmt.Sprintf("hijack failed: %v", err)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	// The client learns about the registration once the session is usable,
+	// nothing is written before it is set.
+	held := &heldConn{Conn: newBufConn(conn, rw)}
+	held.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: " + reverseTunnelProtocol + "\r\n\r\n"))
+
+	done := make(chan struct{})
+	clientConn := &notifyConn{Conn: held, done: done}
+	defer clientConn.Close()
+
+	transport, err := http2.ConfigureTransports(&http.Transport{})
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Error("configure reverse tunnel transport failed", "err", err)
+		}
+		return
+	}
+	cc, err := transport.NewClientConn(clientConn)
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Error("open reverse tunnel failed", "name", name, "err", err)
+		}
+		return
+	}
+	defer cc.Close()
+
+	p.Reverse.set(name, cc)
+	err = held.release()
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Error("open reverse tunnel failed", "name", name, "err", err)
+		}
+		return
+	}
+	if p.Observer != nil {
+		p.Observer.TunnelEstablished(r, name)
+	}
+	start := time.Now()
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+	}
+	// The forwarded connections are also accounted by the clients dialing them.
+	var result tunnelResult
+	result.Upload.Bytes = clientConn.read.Load()
+	result.Download.Bytes = clientConn.written.Load()
+	p.tunnelDone(r, name, start, result)
+}
+
+// notifyConn closes done once the connection fails or is closed,
+// it counts the bytes in both directions.
+type notifyConn struct {
+	net.Conn
+	once    sync.Once
+	done    chan struct{}
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (c *notifyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	if err != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+	return n, err
+}
+
+func (c *notifyConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// heldConn holds back the writes until it is released.
+type heldConn struct {
+	net.Conn
+	mut      sync.Mutex
+	held     []byte
+	released bool
+}
+
+func (c *heldConn) Write(p []byte) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if !c.released {
+		c.held = append(c.held, p...)
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// release writes the held bytes, the later writes go through.
+func (c *heldConn) release() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.released = true
+	_, err := c.Conn.Write(c.held)
+	c.held = nil
+	return err
+}
+
+// pipeConn is a net.Conn over a request body pipe and a response body.
+type pipeConn struct {
+	io.ReadCloser
+	w          *io.PipeWriter
+	cancel     context.CancelFunc
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// CloseWrite ends the request body, the response body stays readable.
+func (c *pipeConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *pipeConn) Close() error {
+	c.w.Close()
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+// Listen registers address on the proxy and returns a listener for the
+// connections the proxy forwards to it. The address is either a name,
+// matching CONNECTs to that host on any port, or a host:port.
+func (d *Dialer) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	conn, err := d.proxyDial(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := d.proxyHeader().Clone()
+	hdr.Set("Connection", "Upgrade")
+	hdr.Set("Upgrade", reverseTunnelProtocol)
+	hdr.Set(ReverseTunnelNameKey, address)
+	upgradeReq := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/"},
+		Host:   d.Proxy,
+		Header: hdr,
+	}
+
+	resp, br, err := d.roundTrip(ctx, conn, upgradeReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("failed listening %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	l := &reverseListener{
+		conn:  conn,
+		addr:  &hostPortAddr{network: network, address: address},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	var server http2.Server
+	go func() {
+		server.ServeConn(&bufConn{conn, br}, &http2.ServeConnOpts{
+			Handler: http.HandlerFunc(l.serveHTTP),
+		})
+		l.Close()
+	}()
+	return l, nil
+}
+
+// reverseListener accepts the connections forwarded by the proxy.
+type reverseListener struct {
+	conn  net.Conn
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *reverseListener) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	stream, err := newStreamConn(w, r)
+	if err != nil {
+		return
+	}
+	conn := &reverseConn{
+		streamConn: stream.(*streamConn),
+		localAddr:  &hostPortAddr{network: l.addr.Network(), address: r.Host},
+		remoteAddr: l.conn.RemoteAddr(),
+		done:       make(chan struct{}),
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		return
+	case <-r.Context().Done():
+		return
+	}
+	// The stream lives as long as the handler.
+	select {
+	case <-conn.done:
+	case <-r.Context().Done():
+		conn.Close()
+	}
+}
+
+func (l *reverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *reverseListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *reverseListener) Addr() net.Addr {
+	return l.addr
+}
+
+// reverseConn is a connection forwarded by the proxy. The stream must not
+// be used once closed, its handler returns afterwards.
+type reverseConn struct {
+	*streamConn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	once       sync.Once
+	done       chan struct{}
+
+	mut    sync.Mutex
+	closed bool
+}
+
+func (c *reverseConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.mut.Lock()
+		c.closed = true
+		c.mut.Unlock()
+		err = c.streamConn.Close()
+		close(c.done)
+	})
+	return err
+}
+
+func (c *reverseConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *reverseConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *reverseConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *reverseConn) SetReadDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *reverseConn) SetWriteDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.rc.SetWriteDeadline(t)
+}
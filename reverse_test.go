@@ -0,0 +1,152 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestReverseTunnel(t *testing.T) {
+	registry := NewReverseRegistry()
+	registry.Authorize = func(identity, name string) bool {
+		return name == "device"
+	}
+	proxy := httptest.NewServer(&ProxyHandler{Reverse: registry})
+	defer proxy.Close()
+
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := dialer.Listen(context.Background(), "tcp", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "check", r.RequestURI)
+	}))
+
+	_, err = dialer.Listen(context.Background(), "tcp", "device")
+	if err == nil {
+		t.Fatal("duplicate endpoint registered")
+	}
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	clients := map[string]*http.Client{
+		"connect": {Transport: &http.Transport{DialContext: dialer.DialContext}},
+		"proxy":   {Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}},
+	}
+	for name, cli := range clients {
+		t.Run(name, func(t *testing.T) {
+			resp, err := cli.Get("http://device/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(body), "/"+name) {
+				t.Fatal(string(body))
+			}
+		})
+	}
+
+	listener.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(registry.Names()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("endpoint not unregistered", registry.Names())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReverseTunnelAuthorization(t *testing.T) {
+	registry := NewReverseRegistry()
+	registry.Domains = []string{"*.tunnel.example"}
+	registry.Authorize = func(identity, name string) bool {
+		return identity == "username" && name == "example.com"
+	}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("username", "password"),
+		Reverse:        registry,
+	})
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("username", "password")
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"device.tunnel.example", "device.tunnel.example:8080", "example.com"} {
+		listener, err := dialer.Listen(context.Background(), "tcp", name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		listener.Close()
+	}
+	for _, name := range []string{"tunnel.example", "www.example.com", "example.com:443"} {
+		_, err := dialer.Listen(context.Background(), "tcp", name)
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatal(name, "registered", err)
+		}
+	}
+}
+
+func TestReverseTunnelDialCanceled(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&http2.Server{}).ServeConn(server, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			// Never answer, like a client that does not accept.
+			<-r.Context().Done()
+			close(canceled)
+		}),
+	})
+	transport, err := http2.ConfigureTransports(&http.Transport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := transport.NewClientConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	registry := NewReverseRegistry()
+	registry.set("device", cc)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = registry.DialContext(ctx, "tcp", "device:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream of the abandoned dial not canceled")
+	}
+}
@@ -0,0 +1,164 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Direct is the route name for dialing without an upstream.
+const Direct = "direct"
+
+// Router picks, per destination, between dialing directly and one of the upstreams.
+type Router struct {
+	// Upstreams are the named parent proxies
+	Upstreams map[string]*Dialer
+	// Sources are the named source addresses of direct connections,
+	// a route naming a source dials directly from it
+	Sources map[string]*SourceAddress
+	// Rules are evaluated in order, the first match wins
+	Rules []Rule
+	// Default is the route if no rule matches, Direct if empty
+	Default string
+	// Logger logs the matched route of each destination if not nil
+	Logger *slog.Logger
+}
+
+// Rule matches a destination, every non-empty condition has to match
+// and a condition matches if any of its values does.
+type Rule struct {
+	// Hosts are patterns of the destination host,
+	// "*" matches any host and "*.example.com" the subdomains of example.com
+	Hosts []string
+	// CIDRs match destinations given as IP addresses
+	CIDRs []netip.Prefix
+	// Ports match the destination port, a value may be a range like "8000-8999"
+	Ports []string
+	// Identities match the identity of the client
+	Identities []string
+	// Route is the name of the upstream, of the source, or Direct
+	Route string
+}
+
+// Match reports whether the rule matches the destination.
+func (r *Rule) Match(host string, port uint16, identity string) bool {
+	if len(r.Hosts) != 0 && !matchAny(r.Hosts, func(pattern string) bool {
+		return matchHost(pattern, host)
+	}) {
+		return false
+	}
+	if len(r.CIDRs) != 0 {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return false
+		}
+		ip = ip.Unmap()
+		if !matchAny(r.CIDRs, func(prefix netip.Prefix) bool {
+			return prefix.Contains(ip)
+		}) {
+			return false
+		}
+	}
+	if len(r.Ports) != 0 && !matchAny(r.Ports, func(ports string) bool {
+		return matchPort(ports, port)
+	}) {
+		return false
+	}
+	if len(r.Identities) != 0 && !matchAny(r.Identities, func(id string) bool {
+		return id == identity
+	}) {
+		return false
+	}
+	return true
+}
+
+// Route returns the route for the destination, the dialer is nil for Direct and sources.
+func (r *Router) Route(ctx context.Context, address string) (string, *Dialer, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	identity := IdentityFromContext(ctx)
+
+	name := r.Default
+	rule := -1
+	for i := range r.Rules {
+		if r.Rules[i].Match(host, uint16(port), identity) {
+			name = r.Rules[i].Route
+			rule = i
+			break
+		}
+	}
+	if name == "" {
+		name = Direct
+	}
+	if r.Logger != nil {
+		r.Logger.Debug("route matched", "address", address, "route", name, "rule", rule)
+	}
+	if name == Direct {
+		return name, nil, nil
+	}
+	d, ok := r.Upstreams[name]
+	if !ok {
+		if _, ok := r.Sources[name]; ok {
+			return name, nil, nil
+		}
+		return "", nil, fmt.Errorf("unknown upstream %q", name)
+	}
+	return name, d, nil
+}
+
+// upstream returns the upstream whose proxy address is address.
+func (r *Router) upstream(address string) (*Dialer, bool) {
+	for _, d := range r.Upstreams {
+		if d.Proxy == address {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+func matchAny[T any](values []T, match func(T) bool) bool {
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+func matchPort(ports string, port uint16) bool {
+	lo, hi, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		hi = lo
+	}
+	min, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return false
+	}
+	max, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return false
+	}
+	return uint64(port) >= min && uint64(port) <= max
+}
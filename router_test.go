@@ -0,0 +1,118 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	rule := Rule{
+		Hosts:      []string{"*.example.com", "10.0.0.1"},
+		Ports:      []string{"443", "8000-8999"},
+		Identities: []string{"alice"},
+	}
+	tests := []struct {
+		host     string
+		port     uint16
+		identity string
+		want     bool
+	}{
+		{"www.example.com", 443, "alice", true},
+		{"a.b.example.com", 8080, "alice", true},
+		{"example.com", 443, "alice", false},
+		{"10.0.0.1", 8999, "alice", true},
+		{"www.example.com", 80, "alice", false},
+		{"www.example.com", 443, "bob", false},
+	}
+	for _, tt := range tests {
+		if got := rule.Match(tt.host, tt.port, tt.identity); got != tt.want {
+			t.Errorf("Match(%q, %d, %q) = %v", tt.host, tt.port, tt.identity, got)
+		}
+	}
+
+	cidr := Rule{CIDRs: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}}
+	if !cidr.Match("192.168.1.1", 80, "") || cidr.Match("192.169.1.1", 80, "") || cidr.Match("example.com", 80, "") {
+		t.Error("CIDR mismatch")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "check", r.RequestURI)
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	var hits atomic.Int32
+	parentHandler := &ProxyHandler{}
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		parentHandler.ServeHTTP(w, r)
+	}))
+	defer parent.Close()
+	upstream, err := NewDialer(parent.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuthFunc(func(username, password string) bool { return true }),
+		Router: &Router{
+			Upstreams: map[string]*Dialer{"parent": upstream},
+			Rules: []Rule{
+				{
+					CIDRs:      []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+					Ports:      []string{targetURL.Port()},
+					Identities: []string{"alice"},
+					Route:      "parent",
+				},
+			},
+		},
+	})
+	defer proxy.Close()
+
+	for _, tt := range []struct {
+		identity string
+		hits     int32
+	}{
+		{"bob", 0},
+		{"alice", 2},
+	} {
+		hits.Store(0)
+		purl, _ := url.Parse(proxy.URL)
+		purl.User = url.UserPassword(tt.identity, "password")
+		dialer, err := NewDialer(purl.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cli := range []*http.Client{
+			{Transport: &http.Transport{DialContext: dialer.DialContext}},
+			{Transport: &http.Transport{Proxy: http.ProxyURL(purl)}},
+		} {
+			resp, err := cli.Get(target.URL + "/router")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatal(resp.Status)
+			}
+		}
+		if hits.Load() != tt.hits {
+			t.Fatalf("%s: parent hits %d, want %d", tt.identity, hits.Load(), tt.hits)
+		}
+	}
+
+	router := &Router{Default: "missing"}
+	if _, _, err := router.Route(context.Background(), "example.com:80"); err == nil {
+		t.Fatal("unknown upstream accepted")
+	}
+}
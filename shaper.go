@@ -0,0 +1,316 @@
+package httpproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// BandwidthLimit is a token bucket limiting one direction.
+type BandwidthLimit struct {
+	// Rate is the sustained rate in bytes per second, unlimited if zero
+	Rate int64
+	// Burst is the size of the bucket in bytes, Rate if zero
+	Burst int64
+}
+
+func (l BandwidthLimit) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// Bandwidth limits both directions.
+type Bandwidth struct {
+	// Upload limits the bytes from the client to the destination
+	Upload BandwidthLimit
+	// Download limits the bytes from the destination to the client
+	Download BandwidthLimit
+}
+
+// Shaper limits the bandwidth of tunnels, proxied requests and UDP datagrams.
+// Every byte is taken from the global bucket, the bucket of the identity of
+// the client and the bucket of the connection, so the lowest of the limits
+// applies. The limits can be changed at any time and apply to the open
+// connections.
+type Shaper struct {
+	mut        sync.Mutex
+	global     shaperBuckets
+	identity   Bandwidth
+	overrides  map[string]Bandwidth
+	identities map[string]*identityBuckets
+	connection Bandwidth
+	conns      map[*shapedConn]struct{}
+}
+
+// shaperBuckets are the buckets of both directions.
+type shaperBuckets struct {
+	upload   bucket
+	download bucket
+}
+
+func (b *shaperBuckets) set(bw Bandwidth) {
+	b.upload.set(bw.Upload)
+	b.download.set(bw.Download)
+}
+
+// identityBuckets are shared by the connections of an identity.
+type identityBuckets struct {
+	shaperBuckets
+	refs int
+}
+
+// SetGlobal sets the limits of all traffic together.
+func (s *Shaper) SetGlobal(bw Bandwidth) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.global.set(bw)
+}
+
+// SetIdentityDefault sets the limits of each identity without its own limits.
+func (s *Shaper) SetIdentityDefault(bw Bandwidth) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.identity = bw
+	for identity, buckets := range s.identities {
+		if _, ok := s.overrides[identity]; !ok {
+			buckets.set(bw)
+		}
+	}
+}
+
+// SetIdentity sets the limits of the traffic of identity.
+func (s *Shaper) SetIdentity(identity string, bw Bandwidth) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.overrides == nil {
+		s.overrides = map[string]Bandwidth{}
+	}
+	s.overrides[identity] = bw
+	if buckets, ok := s.identities[identity]; ok {
+		buckets.set(bw)
+	}
+}
+
+// ResetIdentity makes identity use the default limits again.
+func (s *Shaper) ResetIdentity(identity string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.overrides, identity)
+	if buckets, ok := s.identities[identity]; ok {
+		buckets.set(s.identity)
+	}
+}
+
+// SetConnection sets the limits of each connection.
+func (s *Shaper) SetConnection(bw Bandwidth) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.connection = bw
+	for c := range s.conns {
+		c.set(bw)
+	}
+}
+
+// identityLimits returns the limits of identity, s.mut must be held.
+func (s *Shaper) identityLimits(identity string) Bandwidth {
+	if bw, ok := s.overrides[identity]; ok {
+		return bw
+	}
+	return s.identity
+}
+
+// open returns the buckets of a new connection of identity, anonymous
+// connections only have the global and connection limits.
+func (s *Shaper) open(identity string) *shapedConn {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	c := &shapedConn{shaper: s, identity: identity, done: make(chan struct{})}
+	c.set(s.connection)
+	if identity != "" {
+		buckets, ok := s.identities[identity]
+		if !ok {
+			if s.identities == nil {
+				s.identities = map[string]*identityBuckets{}
+			}
+			buckets = &identityBuckets{}
+			buckets.set(s.identityLimits(identity))
+			s.identities[identity] = buckets
+		}
+		buckets.refs++
+		c.identityBuckets = buckets
+	}
+	if s.conns == nil {
+		s.conns = map[*shapedConn]struct{}{}
+	}
+	s.conns[c] = struct{}{}
+	return c
+}
+
+// shapedConn is the shaping state of a connection.
+type shapedConn struct {
+	shaperBuckets
+	shaper          *Shaper
+	identity        string
+	identityBuckets *identityBuckets
+	// done is closed once the connection is closed, it ends the waits of its readers
+	done chan struct{}
+}
+
+// shapeUpload limits r as traffic from the client.
+func (c *shapedConn) shapeUpload(r io.Reader) io.Reader {
+	return &shapedReader{Reader: r, buckets: c.uploadBuckets(), done: c.done}
+}
+
+// shapeDownload limits r as traffic to the client.
+func (c *shapedConn) shapeDownload(r io.Reader) io.Reader {
+	return &shapedReader{Reader: r, buckets: c.downloadBuckets(), done: c.done}
+}
+
+// waitUpload delays a datagram of n bytes from the client,
+// net.ErrClosed if the connection is closed meanwhile.
+func (c *shapedConn) waitUpload(n int) error {
+	return waitBuckets(c.uploadBuckets(), n, c.done)
+}
+
+// waitDownload delays a datagram of n bytes to the client,
+// net.ErrClosed if the connection is closed meanwhile.
+func (c *shapedConn) waitDownload(n int) error {
+	return waitBuckets(c.downloadBuckets(), n, c.done)
+}
+
+func (c *shapedConn) uploadBuckets() []*bucket {
+	buckets := []*bucket{&c.upload, &c.shaper.global.upload}
+	if c.identityBuckets != nil {
+		buckets = append(buckets, &c.identityBuckets.upload)
+	}
+	return buckets
+}
+
+func (c *shapedConn) downloadBuckets() []*bucket {
+	buckets := []*bucket{&c.download, &c.shaper.global.download}
+	if c.identityBuckets != nil {
+		buckets = append(buckets, &c.identityBuckets.download)
+	}
+	return buckets
+}
+
+// close releases the buckets of the connection and interrupts the waiting reads.
+func (c *shapedConn) close() {
+	s := c.shaper
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.conns[c]; !ok {
+		return
+	}
+	delete(s.conns, c)
+	close(c.done)
+	if c.identityBuckets != nil {
+		c.identityBuckets.refs--
+		if c.identityBuckets.refs == 0 {
+			delete(s.identities, c.identity)
+		}
+	}
+}
+
+// shapedReader delays reads until all of its buckets have the tokens.
+type shapedReader struct {
+	io.Reader
+	buckets []*bucket
+	done    <-chan struct{}
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	// Reading more than the smallest burst at once would exceed it.
+	for _, b := range r.buckets {
+		if max := b.burst(); max > 0 && int64(len(p)) > max {
+			p = p[:max]
+		}
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if werr := waitBuckets(r.buckets, n, r.done); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// waitBuckets takes n tokens from each of buckets and waits until they are paid,
+// net.ErrClosed if done is closed meanwhile.
+func waitBuckets(buckets []*bucket, n int, done <-chan struct{}) error {
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.take(int64(n), now); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return net.ErrClosed
+	}
+}
+
+// bucket is a token bucket, tokens may become negative to delay later reads.
+type bucket struct {
+	mut    sync.Mutex
+	limit  BandwidthLimit
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) set(limit BandwidthLimit) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.limit.Rate <= 0 {
+		// Start with a full bucket.
+		b.tokens = float64(limit.burst())
+		b.last = time.Now()
+	}
+	b.limit = limit
+	if burst := float64(limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// burst returns the size of the bucket, zero if unlimited.
+func (b *bucket) burst() int64 {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.limit.Rate <= 0 {
+		return 0
+	}
+	return b.limit.burst()
+}
+
+// take removes n tokens and returns how long to wait until they are paid.
+func (b *bucket) take(n int64, now time.Time) time.Duration {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.limit.Rate <= 0 {
+		return 0
+	}
+	rate := float64(b.limit.Rate)
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		b.last = now
+	}
+	if burst := float64(b.limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
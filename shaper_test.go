@@ -0,0 +1,217 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	var b bucket
+	b.set(BandwidthLimit{Rate: 1000})
+	now := time.Now()
+	if d := b.take(1000, now); d != 0 {
+		t.Fatal("full bucket waited", d)
+	}
+	if d := b.take(500, now); d != 500*time.Millisecond {
+		t.Fatal(d)
+	}
+	if d := b.take(500, now.Add(time.Second)); d != 0 {
+		t.Fatal("refilled bucket waited", d)
+	}
+	b.set(BandwidthLimit{})
+	if d := b.take(1<<30, now); d != 0 {
+		t.Fatal("unlimited bucket waited", d)
+	}
+}
+
+// shapedTransfer sends n bytes from the target to the client through a
+// tunnel of p and returns how long it took.
+func shapedTransfer(t *testing.T, p *ProxyHandler, identity string, n int) time.Duration {
+	client, clientSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	ctx := ContextWithIdentity(context.Background(), identity)
+	go p.tunnel(ctx, targetSide, clientSide)
+
+	start := time.Now()
+	go func() {
+		target.Write(make([]byte, n))
+		target.Close()
+	}()
+	got, err := io.Copy(io.Discard, client)
+	if err != nil || got != int64(n) {
+		t.Error(got, err)
+	}
+	client.Close()
+	return time.Since(start)
+}
+
+func TestShaperConnection(t *testing.T) {
+	s := &Shaper{}
+	s.SetConnection(Bandwidth{Download: BandwidthLimit{Rate: 100 * 1024, Burst: 10 * 1024}})
+	p := &ProxyHandler{Shaper: s}
+
+	// The burst is free, the rest takes 0.4s.
+	d := shapedTransfer(t, p, "", 50*1024)
+	if d < 300*time.Millisecond || d > 2*time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestShaperIdentity(t *testing.T) {
+	s := &Shaper{}
+	s.SetIdentityDefault(Bandwidth{Download: BandwidthLimit{Rate: 1 << 30}})
+	s.SetIdentity("alice", Bandwidth{Download: BandwidthLimit{Rate: 100 * 1024, Burst: 10 * 1024}})
+	p := &ProxyHandler{Shaper: s}
+
+	// Both connections share the bucket of alice.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i != 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shapedTransfer(t, p, "alice", 25*1024)
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatal("identity limit not shared", d)
+	}
+
+	if d := shapedTransfer(t, p, "bob", 50*1024); d > 200*time.Millisecond {
+		t.Fatal("default limit not applied", d)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	s.mut.Lock()
+	identities := len(s.identities)
+	s.mut.Unlock()
+	if identities != 0 {
+		t.Fatal("buckets of closed connections not released", identities)
+	}
+}
+
+func TestShaperInterrupted(t *testing.T) {
+	s := &Shaper{}
+	// Reading the second KiB waits for ten seconds.
+	s.SetConnection(Bandwidth{Download: BandwidthLimit{Rate: 100, Burst: 1024}})
+	p := &ProxyHandler{Shaper: s, TunnelMaxDuration: 100 * time.Millisecond}
+
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	targetSide, target := tcpPair(t)
+	defer target.Close()
+	go target.Write(make([]byte, 4096))
+
+	start := time.Now()
+	result := p.tunnel(context.Background(), targetSide, clientSide)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatal("closing the tunnel did not interrupt the wait", d)
+	}
+	if result.Timeout != errTunnelMaxDuration {
+		t.Fatal(result.Err())
+	}
+}
+
+func TestShaperRuntimeChange(t *testing.T) {
+	s := &Shaper{}
+	s.SetGlobal(Bandwidth{Download: BandwidthLimit{Rate: 1024}})
+	p := &ProxyHandler{Shaper: s}
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		s.SetGlobal(Bandwidth{})
+	})
+	if d := shapedTransfer(t, p, "", 20*1024); d > 3*time.Second {
+		t.Fatal("limit change not applied", d)
+	}
+}
+
+func TestShaperProxyOther(t *testing.T) {
+	body := make([]byte, 50*1024)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(body)
+	}))
+	defer target.Close()
+	s := &Shaper{}
+	s.SetConnection(Bandwidth{
+		Upload:   BandwidthLimit{Rate: 100 * 1024, Burst: 10 * 1024},
+		Download: BandwidthLimit{Rate: 100 * 1024, Burst: 10 * 1024},
+	})
+	proxy := httptest.NewServer(&ProxyHandler{Shaper: s})
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	start := time.Now()
+	resp, err := cli.Post(target.URL, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if n != int64(len(body)) {
+		t.Fatal(n)
+	}
+	// 0.4s for each direction.
+	if d := time.Since(start); d < 700*time.Millisecond {
+		t.Fatal(d)
+	}
+}
+
+func TestShaperUDP(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	s := &Shaper{}
+	s.SetConnection(Bandwidth{
+		Upload:   BandwidthLimit{Rate: 10 * 1024, Burst: 1024},
+		Download: BandwidthLimit{Rate: 10 * 1024, Burst: 1024},
+	})
+	proxy := httptest.NewServer(&ProxyHandler{Shaper: s, UDPRelay: true})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, open := range map[string]func() (net.PacketConn, error){
+		"connect-udp": func() (net.PacketConn, error) { return dialer.DialUDP("udp", echo.LocalAddr().String()) },
+		"relay":       func() (net.PacketConn, error) { return dialer.ListenPacket(context.Background(), "udp", "") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			start := time.Now()
+			conn.SetDeadline(start.Add(5 * time.Second))
+			datagram := make([]byte, 1024)
+			for i := 0; i != 5; i++ {
+				_, err = conn.WriteTo(datagram, echo.LocalAddr())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i != 5; i++ {
+				_, _, err = conn.ReadFrom(datagram)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 0.1s for each datagram after the burst.
+			if d := time.Since(start); d < 350*time.Millisecond {
+				t.Fatal("datagrams not shaped", d)
+			}
+		})
+	}
+}
@@ -17,6 +17,12 @@ type SimpleServer struct {
 	Address  string
 	Username string
 	Password string
+	// MaxConns limits the concurrent connections, unlimited if zero
+	MaxConns int
+	// QueueConns makes connections over MaxConns wait instead of being answered with 503
+	QueueConns bool
+
+	limitListener net.Listener
 }
 
 // NewSimpleServer creates a new SimpleServer
@@ -60,7 +66,7 @@ func (s *SimpleServer) Run(ctx context.Context) error {
 		s.Listener = listener
 	}
 	s.Address = s.Listener.Addr().String()
-	return s.Server.Serve(s.Listener)
+	return s.Server.Serve(s.listener())
 }
 
 // Start the server
@@ -74,12 +80,24 @@ func (s *SimpleServer) Start(ctx context.Context) error {
 		s.Listener = listener
 	}
 	s.Address = s.Listener.Addr().String()
-	go s.Server.Serve(s.Listener)
+	go s.Server.Serve(s.listener())
 	return nil
 }
 
+// listener returns the listener to serve, limited to MaxConns connections.
+func (s *SimpleServer) listener() net.Listener {
+	if s.MaxConns <= 0 {
+		return s.Listener
+	}
+	s.limitListener = NewLimitListener(s.Listener, s.MaxConns, s.QueueConns)
+	return s.limitListener
+}
+
 // Close closes the listener
 func (s *SimpleServer) Close() error {
+	if s.limitListener != nil {
+		return s.limitListener.Close()
+	}
 	if s.Listener == nil {
 		return nil
 	}
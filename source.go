@@ -0,0 +1,123 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// SourceAddress selects the local address and interface of outbound connections.
+type SourceAddress struct {
+	// Addrs are the local addresses to bind, the system chooses if empty
+	Addrs []netip.Addr
+	// Strategy selects an address of Addrs, RoundRobin if empty;
+	// ConsistentHash keeps the address sticky per identity
+	Strategy Strategy
+	// Interface is the network interface to bind to, only supported on Linux
+	Interface string
+
+	next atomic.Uint64
+}
+
+// Select returns a local address of family ("ip4", "ip6" or empty for any)
+// for the connection of ctx, false if none is available.
+func (s *SourceAddress) Select(ctx context.Context, family string) (netip.Addr, bool) {
+	candidates := make([]netip.Addr, 0, len(s.Addrs))
+	for _, addr := range s.Addrs {
+		addr = addr.Unmap()
+		if family == "" || (family == "ip4") == addr.Is4() {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return netip.Addr{}, false
+	}
+	if s.Strategy == ConsistentHash {
+		if identity := IdentityFromContext(ctx); identity != "" {
+			return candidates[hash32(identity)%uint32(len(candidates))], true
+		}
+	}
+	return candidates[(s.next.Add(1)-1)%uint64(len(candidates))], true
+}
+
+// DialContext connects to the provided address on the provided network from
+// a selected local address. Host names are dialed in the family of the selected address.
+func (s *SourceAddress) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return s.dial(ctx, &net.Dialer{}, network, address)
+}
+
+// Dial connects to the provided address on the provided network from a selected local address.
+func (s *SourceAddress) Dial(network string, address string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+// dial connects with a copy of base bound to the source.
+func (s *SourceAddress) dial(ctx context.Context, base *net.Dialer, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	family := ""
+	if ip, err := netip.ParseAddr(host); err == nil {
+		family = "ip6"
+		if ip.Unmap().Is4() {
+			family = "ip4"
+		}
+	} else if strings.HasSuffix(network, "4") {
+		family = "ip4"
+	} else if strings.HasSuffix(network, "6") {
+		family = "ip6"
+	}
+
+	dialer := *base
+	if len(s.Addrs) != 0 {
+		addr, ok := s.Select(ctx, family)
+		if !ok {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("no %s source address", family)}
+		}
+		if family == "" {
+			network = strings.TrimRight(network, "46")
+			if addr.Is4() {
+				network += "4"
+			} else {
+				network += "6"
+			}
+		}
+		switch {
+		case strings.HasPrefix(network, "tcp"):
+			dialer.LocalAddr = &net.TCPAddr{IP: addr.AsSlice()}
+		case strings.HasPrefix(network, "udp"):
+			dialer.LocalAddr = &net.UDPAddr{IP: addr.AsSlice()}
+		}
+	}
+	if s.Interface != "" {
+		control := base.Control
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				err := control(network, address, c)
+				if err != nil {
+					return err
+				}
+			}
+			return bindToDevice(c, s.Interface)
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+type sourceContextKey struct{}
+
+// contextWithSource returns a copy of ctx carrying the source address of direct connections.
+func contextWithSource(ctx context.Context, source *SourceAddress) context.Context {
+	return context.WithValue(ctx, sourceContextKey{}, source)
+}
+
+// sourceFromContext returns the source address of direct connections, nil if unset.
+func sourceFromContext(ctx context.Context) *SourceAddress {
+	source, _ := ctx.Value(sourceContextKey{}).(*SourceAddress)
+	return source
+}
@@ -0,0 +1,17 @@
+package httpproxy
+
+import (
+	"syscall"
+)
+
+// bindToDevice binds the socket to the network interface with SO_BINDTODEVICE.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
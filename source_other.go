@@ -0,0 +1,14 @@
+//go:build !linux
+
+package httpproxy
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// bindToDevice is only supported on Linux.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return fmt.Errorf("binding to interface %q is not supported on %s", iface, runtime.GOOS)
+}
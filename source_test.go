@@ -0,0 +1,146 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// acceptSources returns a listener and a function returning the source
+// address of the next accepted connection.
+func acceptSources(t *testing.T) (string, func() string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String(), func() string {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		return host
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs the 127.0.0.0/8 loopback of Linux")
+	}
+	address, accept := acceptSources(t)
+	ctx := context.Background()
+
+	s := &SourceAddress{
+		Addrs: []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.3"), netip.MustParseAddr("::1")},
+	}
+	var got []string
+	for i := 0; i != 2; i++ {
+		conn, err := s.DialContext(ctx, "tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, accept())
+		conn.Close()
+	}
+	if got[0] != "127.0.0.2" || got[1] != "127.0.0.3" {
+		t.Fatal("round-robin", got)
+	}
+
+	s.Strategy = ConsistentHash
+	want := ""
+	for i := 0; i != 3; i++ {
+		conn, err := s.DialContext(ContextWithIdentity(ctx, "alice"), "tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := accept()
+		conn.Close()
+		if want == "" {
+			want = source
+		} else if source != want {
+			t.Fatal("not sticky", source, want)
+		}
+	}
+
+	s = &SourceAddress{Addrs: []netip.Addr{netip.MustParseAddr("::1")}}
+	_, err := s.DialContext(ctx, "tcp", address)
+	if err == nil {
+		t.Fatal("dialed IPv4 from an IPv6 source")
+	}
+}
+
+func TestSourceAddressInterface(t *testing.T) {
+	address, accept := acceptSources(t)
+	s := &SourceAddress{Interface: "lo"}
+	conn, err := s.DialContext(context.Background(), "tcp", address)
+	if runtime.GOOS != "linux" {
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		return
+	}
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if source := accept(); source != "127.0.0.1" {
+		t.Fatal(source)
+	}
+}
+
+func TestProxySource(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs the 127.0.0.0/8 loopback of Linux")
+	}
+	address, accept := acceptSources(t)
+	p := &ProxyHandler{
+		Source: &SourceAddress{Addrs: []netip.Addr{netip.MustParseAddr("127.0.0.2")}},
+		Router: &Router{
+			Sources: map[string]*SourceAddress{
+				"egress-b": {Addrs: []netip.Addr{netip.MustParseAddr("127.0.0.3")}},
+			},
+			Rules: []Rule{
+				{Identities: []string{"bob"}, Route: "egress-b"},
+			},
+		},
+	}
+
+	tests := []struct {
+		identity string
+		want     string
+	}{
+		{"alice", "127.0.0.2"},
+		{"bob", "127.0.0.3"},
+	}
+	for _, tt := range tests {
+		conn, err := p.proxyDial(ContextWithIdentity(context.Background(), tt.identity), "tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := accept()
+		conn.Close()
+		if source != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.identity, source, tt.want)
+		}
+	}
+
+	p.DirectDialer = &DirectDialer{}
+	conn, err := p.proxyDial(ContextWithIdentity(context.Background(), "bob"), "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := accept()
+	conn.Close()
+	if source != "127.0.0.3" {
+		t.Fatal("DirectDialer ignored the source", source)
+	}
+}
@@ -0,0 +1,423 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceparentKey is the header carrying the trace context (W3C Trace Context).
+	TraceparentKey = "Traceparent"
+	// TracestateKey is the header carrying vendor specific trace state (W3C Trace Context).
+	TracestateKey = "Tracestate"
+)
+
+const (
+	// DefaultTraceBatchSize is the default maximum number of spans per export.
+	DefaultTraceBatchSize = 512
+	// DefaultTraceBatchTimeout is the default maximum delay of a finished span.
+	DefaultTraceBatchTimeout = 5 * time.Second
+	// DefaultTraceQueueSize is the default maximum number of spans waiting for export.
+	DefaultTraceQueueSize = 2048
+)
+
+var errAuthFailed = errors.New("authentication failed")
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether id is not all zeros.
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// SpanID identifies a span.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether id is not all zeros.
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext is the part of a span propagated to other services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	// TraceState is the tracestate header, it is passed on unchanged
+	TraceState string
+}
+
+// ParseTraceparent parses a traceparent header of version 00, it also
+// accepts later versions as long as they start with the fields of 00.
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(parts[0])); err != nil || version[0] == 0xff ||
+		(version[0] == 0 && len(parts) != 4) || parts[0] != strings.ToLower(parts[0]) {
+		return sc, fmt.Errorf("invalid traceparent version %q", parts[0])
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || !sc.TraceID.IsValid() || parts[1] != strings.ToLower(parts[1]) {
+		return sc, fmt.Errorf("invalid trace id %q", parts[1])
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || !sc.SpanID.IsValid() || parts[2] != strings.ToLower(parts[2]) {
+		return sc, fmt.Errorf("invalid parent id %q", parts[2])
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, fmt.Errorf("invalid trace flags %q", parts[3])
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Traceparent formats the traceparent header of version 00.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// SpanKind is the role of a span.
+type SpanKind int
+
+const (
+	// SpanKindInternal is an operation within the proxy.
+	SpanKindInternal SpanKind = 1
+	// SpanKindServer is a request served by the proxy.
+	SpanKindServer SpanKind = 2
+	// SpanKindClient is a request sent by the proxy.
+	SpanKindClient SpanKind = 3
+)
+
+// Attribute is a key with a value of type string, int64, float64 or bool.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// SpanEvent is a point in time of a span.
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// Span is a timed operation of a trace.
+type Span struct {
+	SpanContext
+	// Parent is the span id of the parent, invalid for the root of a trace
+	Parent     SpanID
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Events     []SpanEvent
+	// Err is the error the span ended with
+	Err error
+
+	tracer *Tracer
+	mut    sync.Mutex
+	ended  bool
+}
+
+type spanContextKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// startChild starts a span below s, the methods of a nil span do nothing.
+func (s *Span) startChild(name string, attrs ...Attribute) *Span {
+	return s.startChildAt(name, time.Now(), attrs...)
+}
+
+func (s *Span) startChildAt(name string, start time.Time, attrs ...Attribute) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		SpanContext: SpanContext{
+			TraceID:    s.TraceID,
+			SpanID:     newSpanID(),
+			Sampled:    s.Sampled,
+			TraceState: s.TraceState,
+		},
+		Parent:     s.SpanID,
+		Name:       name,
+		Kind:       SpanKindInternal,
+		Start:      start,
+		Attributes: attrs,
+		tracer:     s.tracer,
+	}
+}
+
+func (s *Span) setAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.Attributes = append(s.Attributes, attrs...)
+}
+
+func (s *Span) addEvent(name string, attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.Events = append(s.Events, SpanEvent{Name: name, Time: time.Now(), Attributes: attrs})
+}
+
+// end finishes the span and queues it for export if the trace is sampled.
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mut.Lock()
+	if s.ended {
+		s.mut.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.Err = err
+	s.mut.Unlock()
+	if s.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+func newTraceID() (id TraceID) {
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	rand.Read(id[:])
+	return id
+}
+
+// clientTrace records the TLS handshakes and the first byte of the response
+// of a request sent with the returned context.
+func (s *Span) clientTrace(ctx context.Context) context.Context {
+	var mut sync.Mutex
+	var handshake *Span
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			mut.Lock()
+			defer mut.Unlock()
+			handshake = s.startChild("tls")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mut.Lock()
+			defer mut.Unlock()
+			if err == nil {
+				handshake.setAttributes(Attribute{"tls.protocol.version", tls.VersionName(state.Version)})
+			}
+			handshake.end(err)
+		},
+		GotFirstResponseByte: func() {
+			s.addEvent("first byte")
+		},
+	})
+}
+
+// SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// Tracer records a span per request and tunnel of a ProxyHandler, with
+// child spans for the authentication, the dials, the TLS handshakes and the
+// transfer. The spans continue the trace of the traceparent header of the
+// request, or start a new trace, and proxied requests carry the traceparent
+// of the span of the proxy.
+//
+// Finished spans are queued until Run or Flush exports them.
+type Tracer struct {
+	// Exporter receives the finished spans
+	Exporter SpanExporter
+	// BatchSize is the maximum number of spans per export, DefaultTraceBatchSize if zero
+	BatchSize int
+	// BatchTimeout is how often Run exports the queued spans, DefaultTraceBatchTimeout if zero
+	BatchTimeout time.Duration
+	// MaxQueueSize is the maximum number of queued spans, further spans are dropped, DefaultTraceQueueSize if zero
+	MaxQueueSize int
+	// Logger logs failed exports if not nil
+	Logger *slog.Logger
+
+	mut     sync.Mutex
+	queue   []*Span
+	dropped uint64
+	full    chan struct{}
+	once    sync.Once
+}
+
+func (t *Tracer) batchSize() int {
+	if t.BatchSize > 0 {
+		return t.BatchSize
+	}
+	return DefaultTraceBatchSize
+}
+
+func (t *Tracer) fullChan() chan struct{} {
+	t.once.Do(func() {
+		t.full = make(chan struct{}, 1)
+	})
+	return t.full
+}
+
+// startRequest starts the span of the request r.
+func (t *Tracer) startRequest(ctx context.Context, r *http.Request) (context.Context, *Span) {
+	span := &Span{
+		SpanContext: SpanContext{
+			TraceID: newTraceID(),
+			SpanID:  newSpanID(),
+			Sampled: true,
+		},
+		Name:   "proxy " + r.Method,
+		Kind:   SpanKindServer,
+		Start:  time.Now(),
+		tracer: t,
+		Attributes: []Attribute{
+			{"http.request.method", r.Method},
+			{"url.full", accessTarget(r)},
+			{"client.address", clientIP(r)},
+		},
+	}
+	if parent, err := ParseTraceparent(r.Header.Get(TraceparentKey)); err == nil {
+		span.TraceID = parent.TraceID
+		span.Parent = parent.SpanID
+		span.Sampled = parent.Sampled
+		span.TraceState = r.Header.Get(TracestateKey)
+	}
+	span.addEvent("accept")
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// endRequest finishes the span of a request.
+func (s *Span) endRequest(r *http.Request, info RequestInfo) {
+	if s == nil {
+		return
+	}
+	attrs := []Attribute{
+		{"http.response.status_code", int64(info.StatusCode)},
+		{"httpproxy.upload", info.Upload},
+		{"httpproxy.download", info.Download},
+	}
+	if identity := IdentityFromContext(r.Context()); identity != "" {
+		attrs = append(attrs, Attribute{"enduser.id", identity})
+	}
+	if info.Route != "" {
+		attrs = append(attrs, Attribute{"httpproxy.route", info.Route})
+	}
+	if info.Upstream != "" {
+		attrs = append(attrs, Attribute{"httpproxy.upstream", info.Upstream})
+	}
+	s.setAttributes(attrs...)
+	err := info.Err
+	if err == nil && info.StatusCode >= http.StatusInternalServerError {
+		err = errors.New(http.StatusText(info.StatusCode))
+	}
+	s.end(err)
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	max := t.MaxQueueSize
+	if max <= 0 {
+		max = DefaultTraceQueueSize
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if len(t.queue) >= max {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, span)
+	if len(t.queue) >= t.batchSize() {
+		select {
+		case t.fullChan() <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (t *Tracer) Dropped() uint64 {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.dropped
+}
+
+// Flush exports the queued spans.
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.mut.Lock()
+	queue := t.queue
+	t.queue = nil
+	t.mut.Unlock()
+	size := t.batchSize()
+	var errs []error
+	for len(queue) > 0 {
+		n := min(size, len(queue))
+		err := t.Exporter.ExportSpans(ctx, queue[:n])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		queue = queue[n:]
+	}
+	return errors.Join(errs...)
+}
+
+// Run exports the queued spans every BatchTimeout or once a batch is full,
+// and once more when ctx is done.
+func (t *Tracer) Run(ctx context.Context) error {
+	interval := t.BatchTimeout
+	if interval == 0 {
+		interval = DefaultTraceBatchTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			err := t.Flush(context.WithoutCancel(ctx))
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		case <-t.fullChan():
+		}
+		err := t.Flush(ctx)
+		if err != nil && t.Logger != nil {
+			t.Logger.Error("export spans failed", "err", err)
+		}
+	}
+}
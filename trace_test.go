@@ -0,0 +1,329 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		want        string
+		sampled     bool
+	}{
+		{traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sampled: true},
+		{traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{traceparent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03-later", want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sampled: true},
+		{traceparent: ""},
+		{traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.traceparent, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.traceparent)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("want error, got %v", sc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sc.Sampled != tt.sampled || sc.Traceparent() != tt.want {
+				t.Fatalf("got %q sampled %v, want %q sampled %v", sc.Traceparent(), sc.Sampled, tt.want, tt.sampled)
+			}
+		})
+	}
+}
+
+// testCollector is a stand-in for an OTLP/HTTP collector.
+type testCollector struct {
+	*httptest.Server
+	mut       sync.Mutex
+	resources []string
+	spans     []otlpSpan
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var req otlpRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mut.Lock()
+		defer c.mut.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, attr := range rs.Resource.Attributes {
+				c.resources = append(c.resources, attr.Key+"="+*attr.Value.StringValue)
+			}
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// trace returns the received spans of traceID by name.
+func (c *testCollector) trace(traceID string) map[string]otlpSpan {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	spans := map[string]otlpSpan{}
+	for _, span := range c.spans {
+		if span.TraceID == traceID {
+			spans[span.Name] = span
+		}
+	}
+	return spans
+}
+
+// waitTrace flushes tracer until the collector received the spans of traceID named names.
+func waitTrace(t *testing.T, tracer *Tracer, c *testCollector, traceID string, names ...string) map[string]otlpSpan {
+	t.Helper()
+	var spans map[string]otlpSpan
+	for i := 0; i != 50; i++ {
+		err := tracer.Flush(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		spans = c.trace(traceID)
+		if len(spans) == len(names) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, name := range names {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("missing span %q of trace %s in %v", name, traceID, spans)
+		}
+	}
+	return spans
+}
+
+func attribute(span otlpSpan, key string) string {
+	for _, attr := range span.Attributes {
+		if attr.Key != key {
+			continue
+		}
+		switch {
+		case attr.Value.StringValue != nil:
+			return *attr.Value.StringValue
+		case attr.Value.IntValue != nil:
+			return *attr.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func events(span otlpSpan) []string {
+	var names []string
+	for _, event := range span.Events {
+		names = append(names, event.Name)
+	}
+	return names
+}
+
+func TestTracer(t *testing.T) {
+	collector := newTestCollector(t)
+	var mut sync.Mutex
+	var traceparents, tracestates []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		traceparents = append(traceparents, r.Header.Get(TraceparentKey))
+		tracestates = append(tracestates, r.Header.Get(TracestateKey))
+		mut.Unlock()
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer target.Close()
+	tracer := &Tracer{
+		Exporter: &OTLPExporter{URL: collector.URL + "/v1/traces", ServiceName: "test"},
+	}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Authentication: BasicAuth("alice", "secret"),
+		Tracer:         tracer,
+	})
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("alice", "secret")
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	get := func(traceparent string) {
+		req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+		req.Header.Set(TraceparentKey, traceparent)
+		req.Header.Set(TracestateKey, "vendor=1")
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	const traceID, clientSpanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	get("00-" + traceID + "-" + clientSpanID + "-01")
+	spans := waitTrace(t, tracer, collector, traceID, "proxy GET", "auth", "dial", "transfer")
+	root := spans["proxy GET"]
+	if root.ParentSpanID != clientSpanID || root.TraceState != "vendor=1" || root.Kind != SpanKindServer {
+		t.Fatalf("unexpected root span %+v", root)
+	}
+	if got := attribute(root, "http.response.status_code"); got != "200" {
+		t.Errorf("status code %q", got)
+	}
+	if got := attribute(root, "enduser.id"); got != "alice" {
+		t.Errorf("identity %q", got)
+	}
+	if got := strings.Join(events(root), ","); got != "accept,first byte" {
+		t.Errorf("events %q", got)
+	}
+	for _, name := range []string{"auth", "dial", "transfer"} {
+		if spans[name].ParentSpanID != root.SpanID {
+			t.Errorf("span %q is not below the root: %+v", name, spans[name])
+		}
+	}
+	if got := attribute(spans["transfer"], "httpproxy.download"); got != "10" {
+		t.Errorf("transfer download %q", got)
+	}
+	mut.Lock()
+	if want := "00-" + traceID + "-" + root.SpanID + "-01"; traceparents[0] != want || tracestates[0] != "vendor=1" {
+		t.Errorf("destination got traceparent %q tracestate %q, want %q", traceparents[0], tracestates[0], want)
+	}
+	mut.Unlock()
+
+	// Unsampled traces are propagated but not exported.
+	const unsampledID = "0af7651916cd43dd8448eb211c80319c"
+	get("00-" + unsampledID + "-b7ad6b7169203331-00")
+	mut.Lock()
+	if got := traceparents[1]; !strings.HasPrefix(got, "00-"+unsampledID+"-") || !strings.HasSuffix(got, "-00") {
+		t.Errorf("destination got traceparent %q", got)
+	}
+	mut.Unlock()
+
+	// Tunnels start a new trace.
+	dialer, err := NewDialer(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", countingServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello")
+	closeWrite(conn)
+	io.ReadAll(conn)
+	conn.Close()
+	var tunnelTrace string
+	for i := 0; tunnelTrace == "" && i != 50; i++ {
+		tracer.Flush(context.Background())
+		collector.mut.Lock()
+		for _, span := range collector.spans {
+			if span.Name == "proxy CONNECT" {
+				tunnelTrace = span.TraceID
+			}
+		}
+		collector.mut.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans = waitTrace(t, tracer, collector, tunnelTrace, "proxy CONNECT", "auth", "dial", "transfer")
+	if root := spans["proxy CONNECT"]; root.ParentSpanID != "" {
+		t.Errorf("tunnel root has a parent %q", root.ParentSpanID)
+	}
+	if got := attribute(spans["transfer"], "httpproxy.upload"); got != "5" {
+		t.Errorf("tunnel upload %q", got)
+	}
+
+	if got := collector.trace(unsampledID); len(got) != 0 {
+		t.Errorf("unsampled trace exported: %v", got)
+	}
+	collector.mut.Lock()
+	if collector.resources[0] != "service.name=test" {
+		t.Errorf("resource %v", collector.resources)
+	}
+	collector.mut.Unlock()
+}
+
+func TestTracerTLS(t *testing.T) {
+	collector := newTestCollector(t)
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(TraceparentKey))
+	}))
+	defer target.Close()
+	tracer := &Tracer{
+		Exporter: &OTLPExporter{URL: collector.URL + "/v1/traces"},
+	}
+	proxy := httptest.NewServer(&ProxyHandler{
+		Client: target.Client(),
+		Tracer: tracer,
+	})
+	defer proxy.Close()
+
+	// Send an absolute-form https request, clients would use CONNECT.
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target.URL, target.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	sc, err := ParseTraceparent(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := waitTrace(t, tracer, collector, sc.TraceID.String(), "proxy GET", "tls", "transfer")
+	root := spans["proxy GET"]
+	if root.SpanID != sc.SpanID.String() {
+		t.Errorf("destination is below %s, want the root %s", sc.SpanID, root.SpanID)
+	}
+	if spans["tls"].ParentSpanID != root.SpanID || attribute(spans["tls"], "tls.protocol.version") == "" {
+		t.Errorf("unexpected tls span %+v", spans["tls"])
+	}
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+	tracer := &Tracer{Exporter: &OTLPExporter{URL: collector.URL}, MaxQueueSize: 1}
+	span := &Span{SpanContext: SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}, tracer: tracer}
+	span.end(nil)
+	(&Span{SpanContext: span.SpanContext, tracer: tracer}).end(nil)
+	if got := tracer.Dropped(); got != 1 {
+		t.Errorf("dropped %d spans, want 1", got)
+	}
+	err := tracer.Flush(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -2,31 +2,294 @@ package httpproxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// tunnel create tunnels for two io.ReadWriteCloser
-func tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte) error {
-	errCh := make(chan error, 2)
+// DefaultTunnelLinger is how long a tunnel waits for the other direction once one direction finished.
+const DefaultTunnelLinger = 30 * time.Second
+
+var (
+	errTunnelIdleTimeout = errors.New("idle timeout")
+	errTunnelMaxDuration = errors.New("maximum duration reached")
+)
+
+// tunnelResult reports both directions of a tunnel.
+type tunnelResult struct {
+	// Upload is the copy from c2 to c1, the client to the target
+	Upload tunnelDirection
+	// Download is the copy from c1 to c2, the target to the client
+	Download tunnelDirection
+	// Timeout is the timeout that closed the tunnel, nil if none did
+	Timeout error
+}
+
+// tunnelDirection reports one direction of a tunnel.
+type tunnelDirection struct {
+	Bytes int64
+	Err   error
+}
+
+// Err returns the errors of both directions and the timeout.
+func (r tunnelResult) Err() error {
+	var errs []error
+	if r.Timeout != nil {
+		errs = append(errs, r.Timeout)
+	}
+	if r.Upload.Err != nil {
+		errs = append(errs, fmt.Errorf("upload after %d bytes: %w", r.Upload.Bytes, r.Upload.Err))
+	}
+	if r.Download.Err != nil {
+		errs = append(errs, fmt.Errorf("download after %d bytes: %w", r.Download.Bytes, r.Download.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// tunnel copies between c1 and c2 until both directions finished. When a
+// direction reaches EOF the write side of its destination is closed, so
+// protocols that half-close keep working, and the other direction has
+// TunnelLinger to finish. Without half-close support both are closed right away.
+func (p *ProxyHandler) tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser) tunnelResult {
+	linger := p.TunnelLinger
+	if linger == 0 {
+		linger = DefaultTunnelLinger
+	}
+	pool := p.BytesPool
+	if pool == nil {
+		pool = defaultBytesPool
+	}
+	var maxDuration <-chan time.Time
+	if p.TunnelMaxDuration > 0 {
+		timer := time.NewTimer(p.TunnelMaxDuration)
+		defer timer.Stop()
+		maxDuration = timer.C
+	}
+	// Readers wrapping the source of each direction, they disable splicing.
+	var upload, download []func(io.Reader) io.Reader
+	var (
+		activity *atomic.Int64
+		idle     *time.Timer
+		idleC    <-chan time.Time
+	)
+	if p.TunnelIdleTimeout > 0 {
+		activity = &atomic.Int64{}
+		activity.Store(time.Now().UnixNano())
+		idle = time.NewTimer(p.TunnelIdleTimeout)
+		defer idle.Stop()
+		idleC = idle.C
+		active := func(r io.Reader) io.Reader {
+			return &activityReader{r, activity}
+		}
+		upload = append(upload, active)
+		download = append(download, active)
+	}
+	var shaped *shapedConn
+	if p.Shaper != nil {
+		shaped = p.Shaper.open(IdentityFromContext(ctx))
+		upload = append(upload, shaped.shapeUpload)
+		download = append(download, shaped.shapeDownload)
+	}
+
+	type copied struct {
+		upload bool
+		tunnelDirection
+	}
+	ch := make(chan copied, 2)
 	go func() {
-		_, err := io.CopyBuffer(c1, c2, buf1)
-		errCh <- err
+		n, err := copyConn(c1, c2, pool, upload)
+		ch <- copied{true, tunnelDirection{n, err}}
 	}()
 	go func() {
-		_, err := io.CopyBuffer(c2, c1, buf2)
-		errCh <- err
-	}()
-	defer func() {
-		_ = c1.Close()
-		_ = c2.Close()
+		n, err := copyConn(c2, c1, pool, download)
+		ch <- copied{false, tunnelDirection{n, err}}
 	}()
 
-	select {
-	case err := <-errCh:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+	var result tunnelResult
+	closed := false
+	closeBoth := func() {
+		if !closed {
+			closed = true
+			_ = c1.Close()
+			_ = c2.Close()
+			if shaped != nil {
+				shaped.close()
+			}
+		}
+	}
+	defer closeBoth()
+
+	var lingerC <-chan time.Time
+	done := ctx.Done()
+	for pending := 2; pending > 0; {
+		select {
+		case c := <-ch:
+			pending--
+			if c.upload {
+				result.Upload = c.tunnelDirection
+			} else {
+				result.Download = c.tunnelDirection
+			}
+			if pending == 0 {
+				continue
+			}
+			dst := c2
+			if c.upload {
+				dst = c1
+			}
+			if c.Err != nil || closeWrite(dst) != nil {
+				closeBoth()
+				continue
+			}
+			timer := time.NewTimer(linger)
+			defer timer.Stop()
+			lingerC = timer.C
+		case <-lingerC:
+			closeBoth()
+		case <-idleC:
+			if d := time.Since(time.Unix(0, activity.Load())); d < p.TunnelIdleTimeout {
+				idle.Reset(p.TunnelIdleTimeout - d)
+				continue
+			}
+			idleC = nil
+			if !closed {
+				result.Timeout = errTunnelIdleTimeout
+			}
+			closeBoth()
+		case <-maxDuration:
+			maxDuration = nil
+			if !closed {
+				result.Timeout = errTunnelMaxDuration
+			}
+			closeBoth()
+		case <-done:
+			done = nil
+			closeBoth()
+		}
+	}
+	if closed {
+		// Errors caused by closing the connections are not errors of the tunnel.
+		if errors.Is(result.Upload.Err, ctx.Err()) || isClosedErr(result.Upload.Err) {
+			result.Upload.Err = nil
+		}
+		if errors.Is(result.Download.Err, ctx.Err()) || isClosedErr(result.Download.Err) {
+			result.Download.Err = nil
+		}
+	}
+	return result
+}
+
+// copyConn copies from src to dst. Once the bytes buffered by a bufConn are
+// drained, a pair of TCP connections is spliced in the kernel where supported,
+// anything else is copied through a buffer of pool. The source is wrapped by
+// each of wrappers, a copy with wrappers always goes through a buffer.
+func copyConn(dst io.Writer, src io.Reader, pool BytesPool, wrappers []func(io.Reader) io.Reader) (int64, error) {
+	var written int64
+	if c, ok := src.(*bufConn); ok {
+		if c.Reader != nil {
+			buffered, _ := c.Reader.Peek(c.Reader.Buffered())
+			n, err := dst.Write(buffered)
+			written += int64(n)
+			c.Reader.Discard(n)
+			if err != nil {
+				return written, err
+			}
+			c.Reader = nil
+		}
+		src = c.Conn
+	}
+	src = unwrapConn(src).(io.Reader)
+	dst = unwrapConn(dst).(io.Writer)
+
+	for _, wrap := range wrappers {
+		src = wrap(src)
+	}
+	if len(wrappers) == 0 && canSplice {
+		if dst, ok := dst.(*net.TCPConn); ok {
+			if src, ok := src.(*net.TCPConn); ok {
+				n, err := dst.ReadFrom(src)
+				return written + n, err
+			}
+		}
+	}
+
+	buf := pool.Get()
+	defer pool.Put(buf)
+	// Hide io.ReaderFrom and io.WriterTo, they would allocate their own buffers.
+	n, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+	return written + n, err
+}
+
+// activityReader records the time of each read.
+type activityReader struct {
+	io.Reader
+	activity *atomic.Int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.activity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// netConner is a connection wrapper whose data can be copied on the wrapped connection.
+type netConner interface {
+	netConn() net.Conn
+}
+
+// unwrapConn returns the innermost connection of the wrappers around c.
+func unwrapConn(c any) any {
+	for {
+		w, ok := c.(netConner)
+		if !ok {
+			return c
+		}
+		c = w.netConn()
+	}
+}
+
+// defaultBytesPool is used for tunnels if ProxyHandler.BytesPool is nil.
+var defaultBytesPool BytesPool = &syncBytesPool{size: 32 * 1024}
+
+// syncBytesPool is a BytesPool of fixed size buffers backed by a sync.Pool.
+type syncBytesPool struct {
+	size int
+	pool sync.Pool
+}
+
+func (p *syncBytesPool) Get() []byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, p.size)
+}
+
+func (p *syncBytesPool) Put(buf []byte) {
+	if cap(buf) < p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+// isClosedErr reports whether err is caused by closing the connection.
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// closeWrite shuts down the writing side of conn, errors.ErrUnsupported
+// if conn does not support half-close.
+func closeWrite(conn any) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
 	}
+	return errors.ErrUnsupported
 }
 
 // BytesPool is an interface for getting and returning temporary
@@ -0,0 +1,4 @@
+package httpproxy
+
+// canSplice reports whether copying between TCP connections uses splice(2).
+const canSplice = true
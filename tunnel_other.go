@@ -0,0 +1,6 @@
+//go:build !linux
+
+package httpproxy
+
+// canSplice reports whether copying between TCP connections uses splice(2).
+const canSplice = false
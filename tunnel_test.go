@@ -0,0 +1,371 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	c1, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+// countingServer answers the number of bytes it read once the client half-closed.
+func countingServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(io.Discard, conn)
+				fmt.Fprintf(conn, "%d", n)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	proxy := httptest.NewServer(&ProxyHandler{})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", countingServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = closeWrite(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "5" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTunnelResult(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+
+	done := make(chan tunnelResult)
+	go func() {
+		done <- (&ProxyHandler{}).tunnel(context.Background(), targetSide, clientSide)
+	}()
+
+	io.WriteString(client, "request")
+	client.CloseWrite()
+	got, err := io.ReadAll(target)
+	if err != nil || string(got) != "request" {
+		t.Fatal(string(got), err)
+	}
+	io.WriteString(target, "response!")
+	target.CloseWrite()
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "response!" {
+		t.Fatal(string(got), err)
+	}
+
+	result := <-done
+	if result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	if result.Upload.Bytes != 7 || result.Download.Bytes != 9 {
+		t.Fatalf("%+v", result)
+	}
+}
+
+func TestTunnelLinger(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	targetSide, _ := tcpPair(t)
+
+	done := make(chan tunnelResult)
+	go func() {
+		done <- (&ProxyHandler{TunnelLinger: 50 * time.Millisecond}).tunnel(context.Background(), targetSide, clientSide)
+	}()
+	client.CloseWrite()
+
+	select {
+	case result := <-done:
+		if result.Err() != nil {
+			t.Fatal(result.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not give up after the linger timeout")
+	}
+}
+
+func TestTunnelWithoutHalfClose(t *testing.T) {
+	client, clientSide := net.Pipe()
+	targetSide, _ := net.Pipe()
+
+	done := make(chan tunnelResult)
+	go func() {
+		done <- (&ProxyHandler{TunnelLinger: time.Hour}).tunnel(context.Background(), targetSide, clientSide)
+	}()
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel waited for a connection that cannot be half-closed")
+	}
+}
+
+func TestTunnelBufferedBytes(t *testing.T) {
+	proxy := httptest.NewServer(&ProxyHandler{})
+	defer proxy.Close()
+	target := countingServer(t)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The payload arrives together with the CONNECT and is buffered by the server.
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello", target, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "5" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	p := &ProxyHandler{TunnelIdleTimeout: 100 * time.Millisecond}
+
+	done := make(chan tunnelResult)
+	start := time.Now()
+	go func() {
+		done <- p.tunnel(context.Background(), targetSide, clientSide)
+	}()
+
+	// Traffic in either direction keeps the tunnel open.
+	buf := make([]byte, 1)
+	for i := 0; i != 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if i%2 == 0 {
+			client.Write(buf)
+			io.ReadFull(target, buf)
+		} else {
+			target.Write(buf)
+			io.ReadFull(client, buf)
+		}
+	}
+
+	select {
+	case result := <-done:
+		if result.Timeout != errTunnelIdleTimeout {
+			t.Fatal(result.Err())
+		}
+		if time.Since(start) < 250*time.Millisecond {
+			t.Fatal("closed despite traffic")
+		}
+		if result.Upload.Bytes != 2 || result.Download.Bytes != 2 {
+			t.Fatalf("%+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle tunnel was not closed")
+	}
+}
+
+func TestTunnelMaxDuration(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	p := &ProxyHandler{TunnelMaxDuration: 100 * time.Millisecond}
+
+	done := make(chan tunnelResult)
+	go func() {
+		done <- p.tunnel(context.Background(), targetSide, clientSide)
+	}()
+	go io.Copy(io.Discard, target)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				client.Write([]byte("x"))
+			}
+		}
+	}()
+
+	select {
+	case result := <-done:
+		if result.Timeout != errTunnelMaxDuration {
+			t.Fatal(result.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel outlived its maximum duration")
+	}
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name  string
+		proxy *ProxyHandler
+	}{
+		{"response header", &ProxyHandler{ResponseHeaderTimeout: 50 * time.Millisecond}},
+		{"dial", &ProxyHandler{
+			DialTimeout: 50 * time.Millisecond,
+			ProxyDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := httptest.NewServer(tt.proxy)
+			defer proxy.Close()
+			proxyURL, _ := url.Parse(proxy.URL)
+			cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			start := time.Now()
+			resp, err := cli.Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Fatal(resp.Status)
+			}
+			if time.Since(start) > 2*time.Second {
+				t.Fatal("timeout not applied")
+			}
+		})
+	}
+}
+
+func TestProxyResponseTimeouts(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "partial")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name  string
+		proxy *ProxyHandler
+		err   error
+	}{
+		{"idle", &ProxyHandler{TunnelIdleTimeout: 50 * time.Millisecond}, errTunnelIdleTimeout},
+		{"max duration", &ProxyHandler{TunnelMaxDuration: 50 * time.Millisecond}, errTunnelMaxDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			tt.proxy.Client = &http.Client{}
+			tt.proxy.Observer = requestErrObserver(errs)
+			proxy := httptest.NewServer(tt.proxy)
+			defer proxy.Close()
+			proxyURL, _ := url.Parse(proxy.URL)
+			cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			start := time.Now()
+			resp, err := cli.Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "partial" {
+				t.Fatal(string(body))
+			}
+			if time.Since(start) > 2*time.Second {
+				t.Fatal("timeout not applied")
+			}
+			if err := <-errs; err != tt.err {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// requestErrObserver sends the error of each finished request.
+type requestErrObserver chan error
+
+func (requestErrObserver) Accept(r *http.Request)                                 {}
+func (requestErrObserver) AuthSuccess(r *http.Request, identity string)           {}
+func (requestErrObserver) AuthFailure(r *http.Request)                            {}
+func (requestErrObserver) DialStart(ctx context.Context, network, address string) {}
+func (requestErrObserver) DialDone(ctx context.Context, info DialInfo)            {}
+func (requestErrObserver) TunnelEstablished(r *http.Request, address string)      {}
+func (requestErrObserver) TunnelClosed(r *http.Request, info TunnelInfo)          {}
+func (o requestErrObserver) RequestDone(r *http.Request, info RequestInfo)        { o <- info.Err }
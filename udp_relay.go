@@ -0,0 +1,470 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// udpRelayProtocol is the upgrade token of the UDP relay.
+	udpRelayProtocol = "udp-relay"
+
+	// capsuleTypeAddressedDatagram carries a datagram together with its peer address,
+	// the value is the length-prefixed "host:port" followed by the payload.
+	// It is not registered with IANA and only understood by this package.
+	capsuleTypeAddressedDatagram = 0x3f7a2e
+
+	// DefaultUDPRelayIdleTimeout is the default idle timeout of a UDP relay association.
+	DefaultUDPRelayIdleTimeout = 2 * time.Minute
+)
+
+var errTooManyPeers = errors.New("too many peers")
+
+// isUDPRelay reports whether r is a request to upgrade to the UDP relay.
+func isUDPRelay(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerContainsToken(r.Header["Connection"], "upgrade") &&
+		headerContainsToken(r.Header["Upgrade"], udpRelayProtocol)
+}
+
+// appendAddressedDatagram appends a capsule carrying payload for address.
+func appendAddressedDatagram(b []byte, address string, payload []byte) []byte {
+	prefix := appendVarint(nil, uint64(len(address)))
+	return appendCapsule(b, capsuleTypeAddressedDatagram, prefix, []byte(address), payload)
+}
+
+// readAddressedDatagram returns the next addressed datagram, skipping any other capsule.
+func readAddressedDatagram(r *capsuleReader) (string, []byte, error) {
+	for {
+		typ, value, err := r.ReadCapsule()
+		if err != nil {
+			return "", nil, err
+		}
+		if typ != capsuleTypeAddressedDatagram {
+			continue
+		}
+		length, n, err := parseVarint(value)
+		if err != nil {
+			return "", nil, err
+		}
+		value = value[n:]
+		if uint64(len(value)) < length {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+		return string(value[:length]), value[length:], nil
+	}
+}
+
+// proxyUDPRelay serves an unconnected UDP association over an HTTP/1.1 Upgrade.
+func (p *ProxyHandler) proxyUDPRelay(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		e := "not support"
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		e := fmt.Sprintf("hijack failed: %v", err)
+		if p.Logger != nil {
+			p.Logger.Error(e)
+		}
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Upgrade: " + udpRelayProtocol + "\r\n")
+	rw.WriteString(CapsuleProtocolKey + ": ?1\r\n\r\n")
+	clientConn := newBufConn(conn, rw)
+
+	idleTimeout := p.UDPRelayIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultUDPRelayIdleTimeout
+	}
+	a := &udpAssociation{
+		stream:      clientConn,
+		dial:        p.proxyDial,
+		maxPeers:    p.UDPRelayMaxPeers,
+		idleTimeout: idleTimeout,
+		maxDuration: p.TunnelMaxDuration,
+		peers:       map[string]*udpPeer{},
+		peerDone: func(address string, upload, download int64) {
+			p.account(r, address, upload, download)
+		},
+	}
+	if p.Shaper != nil {
+		a.shaped = p.Shaper.open(IdentityFromContext(r.Context()))
+	}
+	if p.Observer != nil {
+		p.Observer.TunnelEstablished(r, "")
+	}
+	start := time.Now()
+	result := a.relay(r.Context())
+	p.tunnelClosed(r, "", start, result)
+}
+
+// udpAssociation relays datagrams between a capsule stream and its peers.
+// Every peer is dialed like a CONNECT-UDP destination, so only peers the
+// client has sent to are able to send back.
+type udpAssociation struct {
+	stream      io.ReadWriteCloser
+	dial        func(ctx context.Context, network, address string) (net.Conn, error)
+	maxPeers    int
+	idleTimeout time.Duration
+	// maxDuration is the maximum lifetime of the association, unlimited if zero
+	maxDuration time.Duration
+	// shaped limits the datagrams of all peers together, unlimited if nil
+	shaped *shapedConn
+	// peerDone is called with the payload bytes of a peer once it is closed
+	peerDone func(address string, upload, download int64)
+
+	idle       *time.Timer
+	errCh      chan udpRelayError
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	// wg waits for the reader of the stream and of each peer
+	wg sync.WaitGroup
+
+	mut   sync.Mutex
+	peers map[string]*udpPeer
+
+	wmut sync.Mutex
+}
+
+// udpPeer is the connection to a peer and its payload bytes.
+type udpPeer struct {
+	conn net.Conn
+
+	mut    sync.Mutex
+	closed bool
+	upload int64
+
+	// download is only written by the reader of the peer
+	download int64
+}
+
+// write sends a datagram to the peer unless it is closed.
+func (p *udpPeer) write(payload []byte) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.closed {
+		return net.ErrClosed
+	}
+	_, err := p.conn.Write(payload)
+	if err == nil {
+		p.upload += int64(len(payload))
+	}
+	return err
+}
+
+// close closes the connection, no more datagrams are sent afterwards.
+func (p *udpPeer) close() {
+	p.mut.Lock()
+	p.closed = true
+	p.mut.Unlock()
+	_ = p.conn.Close()
+}
+
+// udpRelayError is the error that ended an association and its direction.
+type udpRelayError struct {
+	upload bool
+	err    error
+}
+
+// relay relays until the stream or ctx ends, the bytes of the result are
+// the payload bytes of all peers. Every peer is accounted before it returns.
+func (a *udpAssociation) relay(ctx context.Context) tunnelResult {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	a.idle = time.AfterFunc(a.idleTimeout, func() { cancel(errTunnelIdleTimeout) })
+	defer a.idle.Stop()
+	if a.maxDuration > 0 {
+		timer := time.AfterFunc(a.maxDuration, func() { cancel(errTunnelMaxDuration) })
+		defer timer.Stop()
+	}
+
+	a.errCh = make(chan udpRelayError, 1)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		r := newCapsuleReader(a.stream)
+		for {
+			address, payload, err := readAddressedDatagram(r)
+			if err == nil && a.shaped != nil {
+				err = a.shaped.waitUpload(len(payload))
+			}
+			if err != nil {
+				a.fail(true, err)
+				return
+			}
+			a.idle.Reset(a.idleTimeout)
+			peer, err := a.peer(ctx, address)
+			if err != nil {
+				// Like UDP, undeliverable datagrams are dropped.
+				continue
+			}
+			err = peer.write(payload)
+			if err != nil {
+				if !isTransientUDPError(err) {
+					// Its reader ends and accounts it.
+					peer.close()
+				}
+				continue
+			}
+			a.uploaded.Add(int64(len(payload)))
+		}
+	}()
+
+	var result tunnelResult
+	select {
+	case f := <-a.errCh:
+		// The end of the stream closes the association.
+		if f.err != io.EOF && !isClosedErr(f.err) {
+			if f.upload {
+				result.Upload.Err = f.err
+			} else {
+				result.Download.Err = f.err
+			}
+		}
+	case <-ctx.Done():
+		if cause := context.Cause(ctx); cause == errTunnelIdleTimeout || cause == errTunnelMaxDuration {
+			result.Timeout = cause
+		}
+	}
+
+	// Ends a pending dial of a new peer.
+	cancel(nil)
+	_ = a.stream.Close()
+	if a.shaped != nil {
+		a.shaped.close()
+	}
+	a.mut.Lock()
+	peers := a.peers
+	a.peers = nil
+	a.mut.Unlock()
+	for _, peer := range peers {
+		peer.close()
+	}
+	a.wg.Wait()
+
+	result.Upload.Bytes = a.uploaded.Load()
+	result.Download.Bytes = a.downloaded.Load()
+	return result
+}
+
+// fail ends the association with the error of a direction unless it already ended.
+func (a *udpAssociation) fail(upload bool, err error) {
+	select {
+	case a.errCh <- udpRelayError{upload, err}:
+	default:
+	}
+}
+
+// peer returns the connection to address, dialing it as a new peer of the association.
+func (a *udpAssociation) peer(ctx context.Context, address string) (*udpPeer, error) {
+	a.mut.Lock()
+	peer, ok := a.peers[address]
+	full := a.maxPeers > 0 && len(a.peers) >= a.maxPeers
+	a.mut.Unlock()
+	if ok {
+		return peer, nil
+	}
+	if full {
+		return nil, errTooManyPeers
+	}
+
+	conn, err := a.dial(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.peers == nil {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	if a.maxPeers > 0 && len(a.peers) >= a.maxPeers {
+		conn.Close()
+		return nil, errTooManyPeers
+	}
+	peer = &udpPeer{conn: conn}
+	a.peers[address] = peer
+	a.wg.Add(1)
+	go a.readPeer(address, peer)
+	return peer, nil
+}
+
+// readPeer relays the datagrams of a peer to the client, they are
+// addressed with the address the client sent to. Once the peer can no
+// longer be reached it is removed, closed and accounted.
+func (a *udpAssociation) readPeer(address string, peer *udpPeer) {
+	defer a.wg.Done()
+	defer func() {
+		a.mut.Lock()
+		if a.peers[address] == peer {
+			delete(a.peers, address)
+		}
+		a.mut.Unlock()
+		peer.close()
+		if a.peerDone != nil {
+			a.peerDone(address, peer.upload, peer.download)
+		}
+	}()
+	buf := make([]byte, maxUDPPayload)
+	var out []byte
+	for {
+		n, err := peer.conn.Read(buf)
+		if err != nil {
+			if isTransientUDPError(err) {
+				continue
+			}
+			return
+		}
+		a.idle.Reset(a.idleTimeout)
+		if a.shaped != nil && a.shaped.waitDownload(n) != nil {
+			return
+		}
+		a.wmut.Lock()
+		out = appendAddressedDatagram(out[:0], address, buf[:n])
+		_, err = a.stream.Write(out)
+		a.wmut.Unlock()
+		if err != nil {
+			a.fail(false, err)
+			return
+		}
+		peer.download += int64(n)
+		a.downloaded.Add(int64(n))
+	}
+}
+
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// ListenPacket returns a UDP association relayed by the proxy, datagrams can be
+// sent to and received from any address. The address is ignored, the local
+// address is chosen by the proxy.
+func (d *Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	conn, err := d.proxyDial(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := d.proxyHeader().Clone()
+	hdr.Set("Connection", "Upgrade")
+	hdr.Set("Upgrade", udpRelayProtocol)
+	hdr.Set(CapsuleProtocolKey, "?1")
+	upgradeReq := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/"},
+		Host:   d.Proxy,
+		Header: hdr,
+	}
+
+	resp, br, err := d.roundTrip(ctx, conn, upgradeReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, &ConnectError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return &udpRelayConn{
+		conn:    conn,
+		network: network,
+		r:       newCapsuleReader(br),
+	}, nil
+}
+
+// udpRelayConn is an unconnected UDP association relayed by the proxy.
+type udpRelayConn struct {
+	conn    net.Conn
+	network string
+
+	rmut sync.Mutex
+	r    *capsuleReader
+
+	wmut sync.Mutex
+	wbuf []byte
+}
+
+func (c *udpRelayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rmut.Lock()
+	defer c.rmut.Unlock()
+	address, payload, err := readAddressedDatagram(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var addr net.Addr
+	if ap, err := netip.ParseAddrPort(address); err == nil {
+		addr = net.UDPAddrFromAddrPort(ap)
+	} else {
+		addr = &hostPortAddr{network: c.network, address: address}
+	}
+	// Like UDP, excess bytes are discarded.
+	return copy(p, payload), addr, nil
+}
+
+func (c *udpRelayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr == nil {
+		return 0, &net.OpError{Op: "write", Net: c.network, Err: syscall.EDESTADDRREQ}
+	}
+	if len(p) > maxUDPPayload {
+		return 0, &net.OpError{Op: "write", Net: c.network, Addr: addr, Err: syscall.EMSGSIZE}
+	}
+	c.wmut.Lock()
+	defer c.wmut.Unlock()
+	c.wbuf = appendAddressedDatagram(c.wbuf[:0], addr.String(), p)
+	_, err := c.conn.Write(c.wbuf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *udpRelayConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *udpRelayConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *udpRelayConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *udpRelayConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *udpRelayConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,190 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUDPRelay(t *testing.T) {
+	echo1 := udpEchoServer(t)
+	defer echo1.Close()
+	echo2 := udpEchoServer(t)
+	defer echo2.Close()
+
+	proxy := httptest.NewServer(&ProxyHandler{UDPRelay: true})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, echo := range []net.PacketConn{echo1, echo2} {
+		msg := "to " + echo.LocalAddr().String()
+		_, err = conn.WriteTo([]byte(msg), echo.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg || addr.String() != echo.LocalAddr().String() {
+			t.Fatal(string(buf[:n]), addr)
+		}
+	}
+}
+
+func TestUDPRelayLimits(t *testing.T) {
+	echo1 := udpEchoServer(t)
+	defer echo1.Close()
+	echo2 := udpEchoServer(t)
+	defer echo2.Close()
+
+	proxy := httptest.NewServer(&ProxyHandler{
+		UDPRelay:            true,
+		UDPRelayMaxPeers:    1,
+		UDPRelayIdleTimeout: 500 * time.Millisecond,
+	})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1024)
+	conn.WriteTo([]byte("first"), echo1.LocalAddr())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.WriteTo([]byte("second"), echo2.LocalAddr())
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, addr, err := conn.ReadFrom(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("datagram beyond the peer limit was relayed", addr, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadFrom(buf)
+	if err != io.EOF {
+		t.Fatal("association not closed after idle timeout", err)
+	}
+}
+
+func TestUDPRelayDisabled(t *testing.T) {
+	proxy := httptest.NewServer(&ProxyHandler{})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dialer.ListenPacket(context.Background(), "udp", "")
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || connectErr.StatusCode != http.StatusNotFound {
+		t.Fatal("relay not disabled by default", err)
+	}
+}
+
+func TestUDPRelayDialPolicy(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+
+	proxy := httptest.NewServer(&ProxyHandler{
+		UDPRelay: true,
+		DirectDialer: &DirectDialer{
+			Hosts: map[string][]netip.Addr{"echo.test": {netip.MustParseAddr("127.0.0.1")}},
+		},
+	})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	peer := &hostPortAddr{network: "udp", address: net.JoinHostPort("echo.test", port)}
+	_, err = conn.WriteTo([]byte("ping"), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || addr.String() != peer.String() {
+		t.Fatal(string(buf[:n]), addr)
+	}
+}
+
+func TestUDPRelayMaxDuration(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+
+	proxy := httptest.NewServer(&ProxyHandler{
+		UDPRelay:          true,
+		TunnelMaxDuration: 100 * time.Millisecond,
+	})
+	defer proxy.Close()
+	dialer, err := NewDialer(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Echoed datagrams do not keep the association open.
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		conn.WriteTo([]byte("ping"), echo.LocalAddr())
+		_, _, err = conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != io.EOF {
+		t.Fatal("association not closed after its maximum duration", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("closed before its maximum duration")
+	}
+}